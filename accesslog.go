@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// accessLog logs every request handled by handler. Only the path is logged,
+// since the query can carry a token.
+func (s *Server) accessLog(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &loggingResponseWriter{ResponseWriter: w}
+		handler.ServeHTTP(lw, r)
+		code := cmp.Or(lw.code, http.StatusOK)
+		elapsed := time.Since(start)
+		addr := s.clientAddr(r)
+		logEvent(slog.LevelInfo, "request", fmt.Sprintf("%s %s %d %v from %s", r.Method, r.URL.Path, code, elapsed.Round(time.Microsecond), addr),
+			"method", r.Method, "path", r.URL.Path, "key", r.PathValue("key"), "status", code, "duration", elapsed.Seconds(), "remote_addr", addr)
+	})
+}
+
+// loggingResponseWriter remembers the status code of the response.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *loggingResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *loggingResponseWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController flush the events stream.
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack is for the WebSocket upgrade, which doesn't use ResponseController.
+func (w *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.code = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const backupTimeout = 30 * time.Second
+
+// s3Backup keeps a copy of the database in an S3 object, in the format of
+// jsonFileStore.
+type s3Backup struct {
+	client *s3.Client
+	bucket string
+	key    string
+	last   []byte // the last uploaded snapshot, only accessed by backup
+}
+
+// newS3Backup parses a URL like s3://bucket/path/watchdogd.json. A path
+// ending with a slash gets watchdogd.json appended. Credentials and the
+// region come from the usual AWS environment variables, config files or the
+// instance profile.
+func newS3Backup(u string) (*s3Backup, error) {
+	pu, err := url.Parse(u)
+	if err != nil || pu.Scheme != "s3" || pu.Host == "" {
+		return nil, fmt.Errorf("invalid -s3-backup %q, must be s3://bucket/path", u)
+	}
+	key := strings.TrimPrefix(pu.Path, "/")
+	if key == "" || strings.HasSuffix(key, "/") {
+		key += "watchdogd.json"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), backupTimeout)
+	defer cancel()
+	cfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("s3: %w", err)
+	}
+	return &s3Backup{client: s3.NewFromConfig(cfg), bucket: pu.Host, key: key}, nil
+}
+
+func (b *s3Backup) String() string {
+	return "s3://" + b.bucket + "/" + b.key
+}
+
+// download returns the backed up database, or fs.ErrNotExist if there's no
+// backup yet.
+func (b *s3Backup) download() (*database, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), backupTimeout)
+	defer cancel()
+	out, err := b.client.GetObject(ctx, &s3.GetObjectInput{Bucket: &b.bucket, Key: &b.key})
+	var noKey *types.NoSuchKey
+	if errors.As(err, &noKey) {
+		return nil, fs.ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, err
+	}
+	b.last = data
+	return decodeDatabase(data, b.String())
+}
+
+func (b *s3Backup) upload(data []byte) error {
+	if bytes.Equal(data, b.last) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), backupTimeout)
+	defer cancel()
+	_, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &b.bucket,
+		Key:         &b.key,
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return err
+	}
+	b.last = data
+	return nil
+}
+
+// backuper uploads the database every backupInterval.
+func (s *Server) backuper() {
+	ticker := time.NewTicker(s.backupInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.backup()
+	}
+}
+
+// backup uploads the database unless it hasn't changed since the last time.
+// Failures are only logged, the next backup will retry.
+func (s *Server) backup() {
+	if s.readOnly {
+		return // would overwrite the primary's backup
+	}
+	s.backupMu.Lock()
+	defer s.backupMu.Unlock()
+
+	s.mu.RLock()
+	db := s.snapshot(nil)
+	s.mu.RUnlock()
+
+	if err := s.s3.upload(must(json.MarshalIndent(db, "", "  "))); err != nil {
+		logEvent(slog.LevelError, "backup_failed", fmt.Sprintf("backing up to %v failed: %v", s.s3, err), "error", err)
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is the schema of the -config file. Each setting corresponds to the
+// flag named in its flag tag, and can also be set through the environment
+// variable in its env tag. Flags take precedence over the environment, which
+// takes precedence over the file. Durations are written like on the command
+// line, e.g. 30s.
+type config struct {
+	Listen       *string `yaml:"listen" flag:"l" env:"WATCHDOG_LISTEN"`
+	TLSCert      *string `yaml:"tls_cert" flag:"tls-cert" env:"WATCHDOG_TLS_CERT"`
+	TLSKey       *string `yaml:"tls_key" flag:"tls-key" env:"WATCHDOG_TLS_KEY"`
+	ReadTimeout  *string `yaml:"read_timeout" flag:"read-timeout" env:"WATCHDOG_READ_TIMEOUT"`
+	WriteTimeout *string `yaml:"write_timeout" flag:"write-timeout" env:"WATCHDOG_WRITE_TIMEOUT"`
+	IdleTimeout  *string `yaml:"idle_timeout" flag:"idle-timeout" env:"WATCHDOG_IDLE_TIMEOUT"`
+	TrustProxy   *bool   `yaml:"trust_proxy" flag:"trust-proxy" env:"WATCHDOG_TRUST_PROXY"`
+	MaxBodySize  *int64  `yaml:"max_body_size" flag:"max-body-size" env:"WATCHDOG_MAX_BODY_SIZE"`
+	KeyPattern   *string `yaml:"key_pattern" flag:"key-pattern" env:"WATCHDOG_KEY_PATTERN"`
+
+	File         *string `yaml:"file" flag:"f" env:"WATCHDOG_FILE"`
+	DB           *string `yaml:"db" flag:"db" env:"WATCHDOG_DB"`
+	Fsync        *bool   `yaml:"fsync" flag:"fsync" env:"WATCHDOG_FSYNC"`
+	SaveInterval *string `yaml:"save_interval" flag:"save-interval" env:"WATCHDOG_SAVE_INTERVAL"`
+	History      *int    `yaml:"history" flag:"history" env:"WATCHDOG_HISTORY"`
+
+	S3Backup       *string `yaml:"s3_backup" flag:"s3-backup" env:"WATCHDOG_S3_BACKUP"`
+	BackupInterval *string `yaml:"backup_interval" flag:"backup-interval" env:"WATCHDOG_BACKUP_INTERVAL"`
+	EventRetention *string `yaml:"event_retention" flag:"event-retention" env:"WATCHDOG_EVENT_RETENTION"`
+
+	PushgatewayURL      *string `yaml:"pushgateway_url" flag:"pushgateway-url" env:"WATCHDOG_PUSHGATEWAY_URL"`
+	PushgatewayJob      *string `yaml:"pushgateway_job" flag:"pushgateway-job" env:"WATCHDOG_PUSHGATEWAY_JOB"`
+	PushgatewayInterval *string `yaml:"pushgateway_interval" flag:"pushgateway-interval" env:"WATCHDOG_PUSHGATEWAY_INTERVAL"`
+	StatsD              *string `yaml:"statsd" flag:"statsd" env:"WATCHDOG_STATSD"`
+	StatsDInterval      *string `yaml:"statsd_interval" flag:"statsd-interval" env:"WATCHDOG_STATSD_INTERVAL"`
+	OTelEndpoint        *string `yaml:"otel_endpoint" flag:"otel-endpoint" env:"WATCHDOG_OTEL_ENDPOINT"`
+	AccessLog           *bool   `yaml:"access_log" flag:"access-log" env:"WATCHDOG_ACCESS_LOG"`
+	ReadOnly            *bool   `yaml:"read_only" flag:"read-only" env:"WATCHDOG_READ_ONLY"`
+
+	Tokens        []string `yaml:"tokens" flag:"t" env:"WATCHDOG_TOKEN"`
+	TokensFile    *string  `yaml:"tokens_file" flag:"tokens-file" env:"WATCHDOG_TOKENS_FILE"`
+	KeyTokensFile *string  `yaml:"key_tokens" flag:"key-tokens" env:"WATCHDOG_KEY_TOKENS"`
+	ReadToken     *string  `yaml:"read_token" flag:"read-token" env:"WATCHDOG_READ_TOKEN"`
+	MetricsToken  *string  `yaml:"metrics_token" flag:"metrics-token" env:"WATCHDOG_METRICS_TOKEN"`
+	JWTSecret     *string  `yaml:"jwt_secret" flag:"jwt-secret" env:"WATCHDOG_JWT_SECRET"`
+	JWKSURL       *string  `yaml:"jwks_url" flag:"jwks-url" env:"WATCHDOG_JWKS_URL"`
+	JWTAudience   *string  `yaml:"jwt_audience" flag:"jwt-audience" env:"WATCHDOG_JWT_AUDIENCE"`
+	JWTScope      *string  `yaml:"jwt_scope" flag:"jwt-scope" env:"WATCHDOG_JWT_SCOPE"`
+	CORSOrigin    []string `yaml:"cors_origin" flag:"cors-origin" env:"WATCHDOG_CORS_ORIGIN"`
+
+	Webhook         *string `yaml:"webhook" flag:"webhook" env:"WATCHDOG_WEBHOOK"`
+	WebhookSecret   *string `yaml:"webhook_secret" flag:"webhook-secret" env:"WATCHDOG_WEBHOOK_SECRET"`
+	SlackWebhook    *string `yaml:"slack_webhook" flag:"slack-webhook" env:"WATCHDOG_SLACK_WEBHOOK"`
+	WebhookAttempts *int    `yaml:"webhook_attempts" flag:"webhook-attempts" env:"WATCHDOG_WEBHOOK_ATTEMPTS"`
+	WebhookBackoff  *string `yaml:"webhook_backoff" flag:"webhook-backoff" env:"WATCHDOG_WEBHOOK_BACKOFF"`
+	SMTPHost        *string `yaml:"smtp_host" flag:"smtp-host" env:"WATCHDOG_SMTP_HOST"`
+	SMTPPort        *int    `yaml:"smtp_port" flag:"smtp-port" env:"WATCHDOG_SMTP_PORT"`
+	SMTPUser        *string `yaml:"smtp_user" flag:"smtp-user" env:"WATCHDOG_SMTP_USER"`
+	SMTPPass        *string `yaml:"smtp_pass" flag:"smtp-pass" env:"WATCHDOG_SMTP_PASS"`
+	MailFrom        *string `yaml:"mail_from" flag:"mail-from" env:"WATCHDOG_MAIL_FROM"`
+	MailTo          *string `yaml:"mail_to" flag:"mail-to" env:"WATCHDOG_MAIL_TO"`
+	Exec            *string `yaml:"exec" flag:"exec" env:"WATCHDOG_EXEC"`
+	ExecTimeout     *string `yaml:"exec_timeout" flag:"exec-timeout" env:"WATCHDOG_EXEC_TIMEOUT"`
+	RenotifyAfter   *string `yaml:"renotify_after" flag:"renotify-after" env:"WATCHDOG_RENOTIFY_AFTER"`
+	RenotifyMax     *int    `yaml:"renotify_max" flag:"renotify-max" env:"WATCHDOG_RENOTIFY_MAX"`
+	NotifyCooldown  *string `yaml:"notify_cooldown" flag:"notify-cooldown" env:"WATCHDOG_NOTIFY_COOLDOWN"`
+
+	CheckInterval *string  `yaml:"check_interval" flag:"check-interval" env:"WATCHDOG_CHECK_INTERVAL"`
+	StartupGrace  *string  `yaml:"startup_grace" flag:"startup-grace" env:"WATCHDOG_STARTUP_GRACE"`
+	GCAfter       *string  `yaml:"gc_after" flag:"gc-after" env:"WATCHDOG_GC_AFTER"`
+	MaxKeys       *int     `yaml:"max_keys" flag:"max-keys" env:"WATCHDOG_MAX_KEYS"`
+	MinInterval   *string  `yaml:"min_interval" flag:"min-interval" env:"WATCHDOG_MIN_INTERVAL"`
+	MaxInterval   *string  `yaml:"max_interval" flag:"max-interval" env:"WATCHDOG_MAX_INTERVAL"`
+	CheckinRate   *float64 `yaml:"checkin_rate" flag:"checkin-rate" env:"WATCHDOG_CHECKIN_RATE"`
+	CheckinBurst  *int     `yaml:"checkin_burst" flag:"checkin-burst" env:"WATCHDOG_CHECKIN_BURST"`
+
+	DashboardRefresh *string `yaml:"dashboard_refresh" flag:"dashboard-refresh" env:"WATCHDOG_DASHBOARD_REFRESH"`
+	SinceFormat      *string `yaml:"since_format" flag:"since-format" env:"WATCHDOG_SINCE_FORMAT"`
+	TZ               *string `yaml:"tz" flag:"tz" env:"WATCHDOG_TZ"`
+	LogFormat        *string `yaml:"log_format" flag:"log-format" env:"WATCHDOG_LOG_FORMAT"`
+
+	// Keys holds per-key settings.
+	Keys map[string]*keyConfig `yaml:"keys"`
+	// Routes send the notifications about the keys with some prefixes
+	// elsewhere.
+	Routes []*routeConfig `yaml:"routes"`
+	// Maintenance lists recurring windows when alarms don't notify.
+	Maintenance []*maintenanceConfig `yaml:"maintenance"`
+}
+
+type keyConfig struct {
+	Token        string `yaml:"token"` // checkin token, like in -key-tokens
+	Grace        string `yaml:"grace"` // e.g. 10s, or 20% of the interval
+	notifyConfig `yaml:",inline"`
+}
+
+type routeConfig struct {
+	Prefix       string `yaml:"prefix"`
+	notifyConfig `yaml:",inline"`
+}
+
+type maintenanceConfig struct {
+	Keys   string   `yaml:"keys"`   // e.g. batch-*
+	Window string   `yaml:"window"` // e.g. 02:00-04:00, in the -tz time zone
+	Days   []string `yaml:"days"`   // e.g. [sat, sun], every day by default
+}
+
+// notifyConfig replaces the global notification settings for some keys.
+type notifyConfig struct {
+	Webhook      string `yaml:"webhook"`
+	SlackWebhook string `yaml:"slack_webhook"`
+	MailTo       string `yaml:"mail_to"`
+}
+
+func (nc *notifyConfig) destination() (destination, bool) {
+	d := destination{webhookURL: nc.Webhook, slackWebhookURL: nc.SlackWebhook, mailTo: nc.MailTo}
+	return d, d != destination{}
+}
+
+// readConfig parses a config file. Unknown settings are errors, so that
+// typos don't go unnoticed.
+func readConfig(fn string) (*config, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var cfg config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	for key, kc := range cfg.Keys {
+		// the key names are checked by configure, once -key-pattern is known
+		if kc != nil && kc.Grace != "" {
+			if _, err := parseGrace(kc.Grace); err != nil {
+				return nil, fmt.Errorf("%s: key %s: %w", fn, key, err)
+			}
+		}
+	}
+	for i, rc := range cfg.Routes {
+		if rc == nil || rc.Prefix == "" {
+			return nil, fmt.Errorf("%s: route %d has no prefix", fn, i+1)
+		}
+		if _, ok := rc.destination(); !ok {
+			return nil, fmt.Errorf("%s: route %s has no webhook, slack_webhook or mail_to", fn, rc.Prefix)
+		}
+	}
+	for i, mc := range cfg.Maintenance {
+		if mc == nil {
+			return nil, fmt.Errorf("%s: maintenance window %d is empty", fn, i+1)
+		}
+		if _, err := parseWindow(mc.Keys, mc.Window, mc.Days); err != nil {
+			return nil, fmt.Errorf("%s: maintenance window %d: %w", fn, i+1, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// grace is the grace period of a key, either a duration or a percentage
+// of its interval, which /{key}/config can change.
+type grace struct {
+	d   time.Duration
+	pct float64
+}
+
+// of returns the grace period of a key that alarms after alarm.
+func (g grace) of(alarm time.Duration) time.Duration {
+	if g.pct > 0 {
+		return time.Duration(float64(alarm) * g.pct / 100)
+	}
+	return g.d
+}
+
+// parseGrace parses a grace period, like 10s or 20%.
+func parseGrace(v string) (grace, error) {
+	if pct, ok := strings.CutSuffix(v, "%"); ok {
+		n, err := strconv.ParseFloat(pct, 64)
+		if err != nil || n < 0 {
+			return grace{}, fmt.Errorf("invalid grace %q", v)
+		}
+		return grace{pct: n}, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return grace{}, fmt.Errorf("invalid grace %q", v)
+	}
+	return grace{d: d}, nil
+}
+
+// applyConfig sets the flags that weren't given on the command line to the
+// values from cfg.
+func applyConfig(cfg *config, fset *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fset.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	v := reflect.ValueOf(cfg).Elem()
+	for i := range v.NumField() {
+		field, fv := v.Type().Field(i), v.Field(i)
+		name := field.Tag.Get("flag")
+		if name == "" || fv.IsNil() || given[name] {
+			continue
+		}
+		var value string
+		if fv.Kind() == reflect.Slice {
+			value = strings.Join(fv.Interface().([]string), ",")
+		} else {
+			value = fmt.Sprint(fv.Elem().Interface())
+		}
+		if err := fset.Set(name, value); err != nil {
+			return fmt.Errorf("invalid %s %q in config: %w", field.Tag.Get("yaml"), value, err)
+		}
+	}
+	return nil
+}
+
+// applyEnv sets the flags that weren't given on the command line from the
+// WATCHDOG_* environment variables.
+func applyEnv(fset *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fset.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	t := reflect.TypeFor[config]()
+	for i := range t.NumField() {
+		name, env := t.Field(i).Tag.Get("flag"), t.Field(i).Tag.Get("env")
+		value, ok := os.LookupEnv(env)
+		if name == "" || !ok || given[name] {
+			continue
+		}
+		if err := fset.Set(name, value); err != nil {
+			return fmt.Errorf("invalid %s %q: %w", env, value, err)
+		}
+	}
+	return nil
+}
+
+// options are the settings that only take effect on startup.
+type options struct {
+	configFile   string
+	listenAddr   string
+	tlsCert      string
+	tlsKey       string
+	filename     string
+	dbSpec       string
+	s3Backup     string
+	statsd       string
+	otelEndpoint string
+	accessLog    bool
+	fsync        bool
+	logFormat    string
+	showVersion  bool
+
+	readTimeout, writeTimeout, idleTimeout time.Duration
+	eventRetention                         time.Duration // of the Postgres checkin_events
+}
+
+// configure parses the command line into srv and st, filling in what isn't
+// given there from the environment and the config file.
+func configure(fset *flag.FlagSet, args []string, srv *Server, st *settings) (*options, error) {
+	opts := new(options)
+	var tz, tokensFile, keyTokensFile, keyPattern string
+	fset.StringVar(&opts.filename, "f", "", "path to JSON database file")
+	fset.StringVar(&opts.dbSpec, "db", "", "database to use instead of -f, e.g. sqlite:watchdog.db")
+	fset.Int64Var(&srv.maxBodySize, "max-body-size", srv.maxBodySize, "maximum size of checkin request bodies in bytes, larger ones get 413")
+	fset.StringVar(&keyPattern, "key-pattern", defaultKeyPattern, "regexp that key names must match, not counting the interval suffix and the ~ of inverse keys")
+	fset.IntVar(&srv.historySize, "history", srv.historySize, "number of recent checkins to remember per key")
+	fset.DurationVar(&srv.saveInterval, "save-interval", srv.saveInterval, "minimum delay between database saves")
+	fset.BoolVar(&opts.fsync, "fsync", false, "fsync the database file on every save")
+	fset.DurationVar(&opts.eventRetention, "event-retention", 0, "with Postgres, delete checkin_events older than this, e.g. 2160h (0 keeps them forever)")
+	fset.StringVar(&opts.s3Backup, "s3-backup", "", "back up the database to S3, e.g. s3://bucket/path, and restore from it when the database is missing")
+	fset.DurationVar(&srv.backupInterval, "backup-interval", srv.backupInterval, "how often to upload the -s3-backup")
+	fset.StringVar(&srv.pushURL, "pushgateway-url", "", "Prometheus Pushgateway to push the /metrics gauges to, e.g. http://pushgateway:9091")
+	fset.StringVar(&srv.pushJob, "pushgateway-job", srv.pushJob, "job label of the pushed metrics")
+	fset.DurationVar(&srv.pushInterval, "pushgateway-interval", srv.pushInterval, "how often to push the metrics to the Pushgateway")
+	fset.StringVar(&opts.statsd, "statsd", "", "StatsD address to send the metrics to over UDP, e.g. 127.0.0.1:8125")
+	fset.DurationVar(&srv.statsdInterval, "statsd-interval", srv.statsdInterval, "how often to send the metrics to -statsd")
+	fset.StringVar(&opts.otelEndpoint, "otel-endpoint", "", "OTLP/HTTP collector to send request traces to, e.g. http://collector:4318")
+	fset.Func("t", "bearer token for authorization (can be repeated or comma-separated)", func(v string) error {
+		st.authTokens = append(st.authTokens, splitList(v)...)
+		return nil
+	})
+	fset.StringVar(&tokensFile, "tokens-file", "", "file with additional bearer tokens, one per line")
+	fset.StringVar(&keyTokensFile, "key-tokens", "", "file with per-key checkin tokens, one 'key token' pair per line")
+	fset.StringVar(&st.readToken, "read-token", "", "bearer token required to view statuses (public by default)")
+	fset.StringVar(&st.metricsToken, "metrics-token", "", "bearer token required by /metrics (public by default)")
+	fset.StringVar(&st.jwtSecret, "jwt-secret", "", "accept JWTs signed with this HS256 secret instead of the -t tokens")
+	fset.StringVar(&st.jwksURL, "jwks-url", "", "accept JWTs signed with the keys published at this JWKS URL instead of the -t tokens")
+	fset.StringVar(&st.jwtAudience, "jwt-audience", "", "audience the JWTs must be issued for (required with -jwt-secret and -jwks-url)")
+	fset.StringVar(&st.jwtScope, "jwt-scope", "", "scope the JWTs must have, if any")
+	fset.Func("cors-origin", "origin allowed to read the status endpoints from browsers, e.g. https://status.example.com or * (can be repeated or comma-separated)", func(v string) error {
+		st.corsOrigins = append(st.corsOrigins, splitList(v)...)
+		return nil
+	})
+	fset.BoolVar(&srv.readOnly, "read-only", false, "serve the status, but refuse checkins, acks and deletes, and never save the database, e.g. on a standby")
+	fset.BoolVar(&srv.trustProxy, "trust-proxy", false, "take client addresses from X-Forwarded-For, set when behind a reverse proxy")
+	fset.StringVar(&opts.listenAddr, "l", ":8080", "listen address, or unix:PATH for a unix socket")
+	fset.StringVar(&opts.tlsCert, "tls-cert", "", "TLS certificate file; serves HTTPS when set together with -tls-key")
+	fset.StringVar(&opts.tlsKey, "tls-key", "", "TLS private key file")
+	fset.DurationVar(&opts.readTimeout, "read-timeout", 10*time.Second, "maximum duration for reading a request")
+	fset.DurationVar(&opts.writeTimeout, "write-timeout", 10*time.Second, "maximum duration for writing a response")
+	fset.DurationVar(&opts.idleTimeout, "idle-timeout", 120*time.Second, "how long to keep idle keep-alive connections open")
+	fset.StringVar(&st.webhookURL, "webhook", "", "URL to POST alarm notifications to")
+	fset.StringVar(&st.slackWebhookURL, "slack-webhook", "", "Slack incoming webhook URL to post alarm notifications to")
+	fset.StringVar(&st.webhookSecret, "webhook-secret", "", "secret to sign -webhook requests with, see X-Watchdog-Signature in the README")
+	fset.IntVar(&st.webhookAttempts, "webhook-attempts", st.webhookAttempts, "how many times to try delivering each webhook notification")
+	fset.DurationVar(&st.webhookBackoff, "webhook-backoff", st.webhookBackoff, "delay before retrying a failed webhook, doubled for every next retry")
+	fset.StringVar(&st.smtpHost, "smtp-host", "", "SMTP server to send alarm emails through")
+	fset.IntVar(&st.smtpPort, "smtp-port", st.smtpPort, "SMTP server port")
+	fset.StringVar(&st.smtpUser, "smtp-user", "", "SMTP username")
+	fset.StringVar(&st.smtpPass, "smtp-pass", "", "SMTP password")
+	fset.StringVar(&st.mailFrom, "mail-from", "", "sender address for alarm emails")
+	fset.StringVar(&st.mailTo, "mail-to", "", "comma-separated recipients of alarm emails")
+	fset.StringVar(&st.execCommand, "exec", "", "shell command to run when a key goes into ALARM (gets WATCHDOG_KEY, WATCHDOG_STATUS and WATCHDOG_SINCE_SECONDS)")
+	fset.DurationVar(&st.execTimeout, "exec-timeout", st.execTimeout, "maximum run time of the -exec command")
+	fset.DurationVar(&st.renotifyAfter, "renotify-after", 0, "notify again about keys still in ALARM after this long, doubling the interval every time, e.g. 30m")
+	fset.DurationVar(&st.notifyCooldown, "notify-cooldown", st.notifyCooldown, "after a notification about a key, hold back the next ones for this long and then send only the latest (0 disables)")
+	fset.IntVar(&st.renotifyMax, "renotify-max", 0, "maximum number of repeated notifications per alarm (0 means no limit)")
+	fset.DurationVar(&srv.dashboardRefresh, "dashboard-refresh", srv.dashboardRefresh, "how often the HTML dashboard reloads itself")
+	fset.Float64Var(&st.checkinRate, "checkin-rate", 0, "checkins per second allowed per key, more get 429 (0 means no limit)")
+	fset.IntVar(&st.checkinBurst, "checkin-burst", st.checkinBurst, "number of checkins per key allowed in a burst above -checkin-rate")
+	fset.IntVar(&st.maxKeys, "max-keys", 0, "maximum number of keys, checkins of new keys above it get 429 (0 means no limit)")
+	fset.DurationVar(&st.minInterval, "min-interval", 0, "refuse checkins of keys with shorter intervals with 400, e.g. 1m")
+	fset.DurationVar(&st.maxInterval, "max-interval", 0, "refuse checkins of keys with longer intervals with 400, e.g. 720h (0 means no limit)")
+	fset.DurationVar(&st.gcAfter, "gc-after", 0, "forget keys that haven't checked in for this long, e.g. 720h (0 keeps them forever)")
+	fset.DurationVar(&srv.checkInterval, "check-interval", srv.checkInterval, "how often to check keys for alarms")
+	fset.DurationVar(&srv.startupGrace, "startup-grace", 0, "after a restart, give keys this long to check in before reporting the ones that became overdue meanwhile, e.g. 60s")
+	fset.BoolVar(&opts.accessLog, "access-log", false, "log every request")
+	fset.StringVar(&opts.logFormat, "log-format", "text", "log format, text or json")
+	fset.StringVar(&tz, "tz", "UTC", "time zone for displaying times, e.g. America/New_York or Local")
+	fset.StringVar(&srv.sinceFormat, "since-format", srv.sinceFormat, "how to show the time since the last checkin in text output, units (2h 5m 3s) or relative (2 hours ago)")
+	fset.StringVar(&opts.configFile, "config", "", "YAML config file; flags override its settings, reloaded on SIGHUP")
+	fset.BoolVar(&opts.showVersion, "version", false, "print version and exit")
+	if err := fset.Parse(args); err != nil {
+		return nil, err
+	}
+	if opts.showVersion {
+		return opts, nil
+	}
+
+	if err := applyEnv(fset); err != nil {
+		return nil, err
+	}
+	if opts.configFile == "" {
+		opts.configFile = os.Getenv("WATCHDOG_CONFIG")
+	}
+	var cfg *config
+	if opts.configFile != "" {
+		var err error
+		cfg, err = readConfig(opts.configFile)
+		if err == nil {
+			err = applyConfig(cfg, fset)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := setKeyPattern(keyPattern); err != nil {
+		return nil, fmt.Errorf("invalid -key-pattern: %w", err)
+	}
+	if loc, err := time.LoadLocation(tz); err != nil {
+		return nil, fmt.Errorf("invalid -tz: %w", err)
+	} else {
+		srv.location = loc
+	}
+	if srv.sinceFormat != sinceUnits && srv.sinceFormat != sinceRelative {
+		return nil, fmt.Errorf("invalid -since-format %q, must be units or relative", srv.sinceFormat)
+	}
+	if srv.checkInterval <= 0 {
+		return nil, fmt.Errorf("invalid -check-interval %v, must be positive", srv.checkInterval)
+	}
+	if srv.pushURL != "" && srv.pushInterval <= 0 {
+		return nil, fmt.Errorf("invalid -pushgateway-interval %v, must be positive", srv.pushInterval)
+	}
+	if opts.statsd != "" && srv.statsdInterval <= 0 {
+		return nil, fmt.Errorf("invalid -statsd-interval %v, must be positive", srv.statsdInterval)
+	}
+	if st.maxInterval > 0 && st.minInterval > st.maxInterval {
+		return nil, fmt.Errorf("invalid -max-interval %v, must not be below -min-interval %v", st.maxInterval, st.minInterval)
+	}
+
+	if tokensFile != "" {
+		tokens, err := readLines(tokensFile)
+		if err != nil {
+			return nil, err
+		}
+		st.authTokens = append(st.authTokens, tokens...)
+	}
+	if st.jwtSecret != "" && st.jwksURL != "" {
+		return nil, errors.New("-jwt-secret and -jwks-url are mutually exclusive")
+	}
+	if st.jwtEnabled() && st.jwtAudience == "" {
+		return nil, errors.New("-jwt-audience is required with -jwt-secret and -jwks-url")
+	}
+	if st.jwtEnabled() && len(st.authTokens) > 0 {
+		return nil, errors.New("-t and -tokens-file can't be combined with -jwt-secret and -jwks-url")
+	}
+	if cfg != nil && len(cfg.Keys) > 0 {
+		for key := range cfg.Keys {
+			if _, ok := parse(key); !ok && !validName(key) { // the latter set with /{key}/config
+				return nil, fmt.Errorf("%s: invalid key %q", opts.configFile, key)
+			}
+		}
+		st.keyTokens = make(map[string]string)
+		st.keyGrace = make(map[string]grace)
+		for key, kc := range cfg.Keys {
+			if kc == nil {
+				continue
+			}
+			if kc.Token != "" {
+				st.keyTokens[key] = kc.Token
+			}
+			if kc.Grace != "" {
+				st.keyGrace[key] = must(parseGrace(kc.Grace)) // validated by readConfig
+			}
+			if d, ok := kc.destination(); ok {
+				st.routes = append(st.routes, route{prefix: key, exact: true, destination: d})
+			}
+		}
+	}
+	if cfg != nil {
+		for _, rc := range cfg.Routes {
+			d, _ := rc.destination()
+			st.routes = append(st.routes, route{prefix: rc.Prefix, destination: d})
+		}
+		for _, mc := range cfg.Maintenance {
+			st.maintenance = append(st.maintenance, must(parseWindow(mc.Keys, mc.Window, mc.Days))) // validated by readConfig
+		}
+	}
+	if keyTokensFile != "" {
+		tokens, err := readKeyTokensFile(keyTokensFile)
+		if err != nil {
+			return nil, err
+		}
+		if st.keyTokens == nil {
+			st.keyTokens = tokens
+		} else {
+			maps.Copy(st.keyTokens, tokens)
+		}
+	}
+	return opts, nil
+}
+
+// reload re-reads the configuration (the environment, the config file and
+// the token files) and swaps in the new settings. Settings that only take
+// effect on startup, like the listen address, are left alone. On errors, the
+// old settings stay in place.
+func (s *Server) reload(args []string) {
+	fset := flag.NewFlagSet("watchdogd", flag.ContinueOnError)
+	fset.SetOutput(io.Discard)
+	st := defaultSettings()
+	pattern := nameRe.Load()
+	if _, err := configure(fset, args, newServer(), st); err != nil {
+		nameRe.Store(pattern)
+		logEvent(slog.LevelError, "reload_failed", fmt.Sprintf("reloading config failed, keeping the old settings: %v", err), "error", err)
+		return
+	}
+	old := s.settings()
+	if len(st.authTokens) == 0 {
+		st.authTokens = old.authTokens // the random token from startup
+	}
+	s.current.Store(st)
+
+	changed := changedSettings(old, st)
+	if nameRe.Load().String() != pattern.String() {
+		changed = append(changed, "key-pattern")
+	}
+	if len(changed) == 0 {
+		logEvent(slog.LevelInfo, "reload", "reloaded config, nothing changed")
+	} else {
+		logEvent(slog.LevelInfo, "reload", fmt.Sprintf("reloaded config, changed -%s", strings.Join(changed, ", -")), "changed", changed)
+	}
+}
+
+// changedSettings returns the flag names of the settings that differ. The
+// values aren't returned since many of them are secrets.
+func changedSettings(a, b *settings) []string {
+	var changed []string
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := range va.NumField() {
+		// fields are unexported, so compare their printed forms (nil and
+		// empty maps print the same, and map keys are printed sorted)
+		if fmt.Sprint(va.Field(i)) != fmt.Sprint(vb.Field(i)) {
+			changed = append(changed, va.Type().Field(i).Tag.Get("flag"))
+		}
+	}
+	return changed
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigurePrecedence(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		config  string
+		args    []string
+		webhook string
+		after   time.Duration
+		err     bool
+	}{
+		{name: "defaults"},
+		{name: "env only", env: map[string]string{"WATCHDOG_WEBHOOK": "http://env", "WATCHDOG_RENOTIFY_AFTER": "30m"}, webhook: "http://env", after: 30 * time.Minute},
+		{name: "config only", config: "webhook: http://config\nrenotify_after: 1h\n", webhook: "http://config", after: time.Hour},
+		{name: "env over config", env: map[string]string{"WATCHDOG_WEBHOOK": "http://env"}, config: "webhook: http://config\nrenotify_after: 1h\n", webhook: "http://env", after: time.Hour},
+		{name: "flag over env", env: map[string]string{"WATCHDOG_WEBHOOK": "http://env", "WATCHDOG_RENOTIFY_AFTER": "30m"}, args: []string{"-webhook", "http://flag"}, webhook: "http://flag", after: 30 * time.Minute},
+		{name: "flag over env and config", env: map[string]string{"WATCHDOG_RENOTIFY_AFTER": "30m"}, config: "renotify_after: 1h\n", args: []string{"-renotify-after", "2h"}, after: 2 * time.Hour},
+		{name: "invalid env", env: map[string]string{"WATCHDOG_RENOTIFY_AFTER": "soon"}, err: true},
+		{name: "invalid env under a flag", env: map[string]string{"WATCHDOG_RENOTIFY_AFTER": "soon"}, args: []string{"-renotify-after", "2h"}, after: 2 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"WATCHDOG_WEBHOOK", "WATCHDOG_RENOTIFY_AFTER", "WATCHDOG_CONFIG"} {
+				t.Setenv(name, tt.env[name])
+				if _, ok := tt.env[name]; !ok {
+					os.Unsetenv(name)
+				}
+			}
+			args := tt.args
+			if tt.config != "" {
+				fn := filepath.Join(t.TempDir(), "watchdog.yaml")
+				if err := os.WriteFile(fn, []byte(tt.config), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				args = append([]string{"-config", fn}, args...)
+			}
+			fset := flag.NewFlagSet("watchdogd", flag.ContinueOnError)
+			fset.SetOutput(io.Discard)
+			st := defaultSettings()
+			_, err := configure(fset, args, newServer(), st)
+			if tt.err {
+				if err == nil {
+					t.Fatal("configure succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.webhookURL != tt.webhook || st.renotifyAfter != tt.after {
+				t.Errorf("got -webhook %q and -renotify-after %v, want %q and %v", st.webhookURL, st.renotifyAfter, tt.webhook, tt.after)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "watchdog.yaml")
+	write := func(config string) {
+		if err := os.WriteFile(fn, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("webhook: http://hook\nrenotify_after: 30m\n")
+	args := []string{"-config", fn, "-mail-to", "ops@example.com"}
+	s := testServer() // has a -t token that reloads must keep
+	st := defaultSettings()
+	fset := flag.NewFlagSet("watchdogd", flag.ContinueOnError)
+	if _, err := configure(fset, args, newServer(), st); err != nil {
+		t.Fatal(err)
+	}
+	st.authTokens = s.settings().authTokens
+	s.current.Store(st)
+
+	s.reload(args)
+	if changed := changedSettings(st, s.settings()); len(changed) != 0 {
+		t.Errorf("reload without changes changed %v", changed)
+	}
+
+	write("webhook: http://hook\nrenotify_after: 1h\n")
+	s.reload(args)
+	reloaded := s.settings()
+	if changed := changedSettings(st, reloaded); !reflect.DeepEqual(changed, []string{"renotify-after"}) {
+		t.Errorf("reload changed %v, want [renotify-after]", changed)
+	}
+	if reloaded.renotifyAfter != time.Hour || reloaded.webhookURL != "http://hook" || reloaded.mailTo != "ops@example.com" {
+		t.Errorf("reloaded -renotify-after %v, -webhook %q, -mail-to %q", reloaded.renotifyAfter, reloaded.webhookURL, reloaded.mailTo)
+	}
+	if !reflect.DeepEqual(reloaded.authTokens, []string{"adm"}) {
+		t.Errorf("reloaded tokens are %q, want the old ones", reloaded.authTokens)
+	}
+
+	write("renotify_after: never\n")
+	s.reload(args)
+	if s.settings() != reloaded {
+		t.Error("a broken config file replaced the settings")
+	}
+}
+
+func TestKeyGrace(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "watchdog.yaml")
+	cfg := "keys:\n  backup:\n    grace: 20%\n  db-1h:\n    grace: 10%\n  web-1h:\n    grace: 30s\n"
+	if err := os.WriteFile(fn, []byte(cfg), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := testServer()
+	st := defaultSettings()
+	if _, err := configure(flag.NewFlagSet("watchdogd", flag.ContinueOnError), []string{"-config", fn, "-t", "adm"}, s, st); err != nil {
+		t.Fatal(err)
+	}
+	s.current.Store(st)
+	h := s.Handler()
+	for _, target := range []string{"/backup/config?interval=2h", "/db-1h/config?interval=30m", "/web-1h/config?interval=2h"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, testRequest("POST", target))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("POST %s got %d", target, w.Code)
+		}
+	}
+	for key, want := range map[string]time.Duration{"backup": 24 * time.Minute, "db-1h": 3 * time.Minute, "web-1h": 30 * time.Second} {
+		if lim, _ := s.limits(key); lim.grace != want {
+			t.Errorf("%s has grace %v, want %v", key, lim.grace, want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+)
+
+// corsMiddleware lets the pages of the -cors-origin origins read the
+// responses of handler. Only read endpoints get it, so that other sites
+// can't make browsers check in or delete keys.
+func (s *Server) corsMiddleware(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.allowOrigin(w, r)
+		handler(w, r)
+	}
+}
+
+// preflightHandler answers the OPTIONS requests browsers send before
+// cross-origin requests with an Authorization header.
+func (s *Server) preflightHandler(w http.ResponseWriter, r *http.Request) {
+	if s.allowOrigin(w, r) {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Accept")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowOrigin sets Access-Control-Allow-Origin if the request comes from an
+// allowed origin.
+func (s *Server) allowOrigin(w http.ResponseWriter, r *http.Request) bool {
+	origins := s.settings().corsOrigins
+	if len(origins) == 0 {
+		return false
+	}
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	if slices.Contains(origins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else if slices.Contains(origins, origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	} else {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+var dashboardTmpl = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.RefreshSeconds}}">
+<title>watchdogd</title>
+<style>
+body { font-family: -apple-system, system-ui, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; }
+th, td { padding: 0.4em 1em; text-align: left; }
+th { border-bottom: 2px solid #ccc; }
+tr.OKAY { background: #d4f7d4; }
+tr.ALARM { background: #f7d4d4; }
+tr.WARN, tr.LATE { background: #f7f3c4; }
+tr.ACKED { background: #f7ecd4; }
+tr.NEVER { background: #e8e8e8; color: #777; }
+</style>
+</head>
+<body>
+<h1>watchdogd has {{.Count}} keys</h1>
+<table>
+<tr><th>Key</th><th>Status</th><th>Last checkin</th><th>Since</th><th>From</th><th>Note</th></tr>
+{{range .Keys}}<tr class="{{.Status}}"><td>{{.Key}}</td><td>{{.Status}}{{if .State}} ({{.State}}){{end}}</td><td>{{if .LastCheckin}}{{.Local.Format "2006-01-02T15:04:05Z07:00"}}{{else}}never{{end}}</td><td>{{if .LastCheckin}}{{.Since}}{{end}}</td><td>{{.Source}}</td><td>{{.Note}}</td></tr>
+{{end}}</table>
+<p>Updated {{.Now.Format "2006-01-02T15:04:05Z07:00"}}, refreshes every {{.RefreshSeconds}}s.</p>
+</body>
+</html>
+`))
+
+type dashboardRow struct {
+	*keyStatus
+	Local time.Time // last checkin in the display time zone
+	Since time.Duration
+}
+
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func (s *Server) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	resp := s.List()
+	slices.SortFunc(resp.Keys, listOrders["key"])
+	s.renderDashboard(w, resp)
+}
+
+// renderDashboard shows the keys in the order they come in, e.g. the ?sort=
+// order of the list.
+func (s *Server) renderDashboard(w http.ResponseWriter, resp *listResponse) {
+	rows := make([]dashboardRow, 0, len(resp.Keys))
+	for _, st := range resp.Keys {
+		rows = append(rows, dashboardRow{st, st.lastCheckin.In(s.location), st.since.Round(time.Second)})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := dashboardTmpl.Execute(w, map[string]any{
+		"Count":          resp.Count,
+		"Keys":           rows,
+		"Now":            now().In(s.location),
+		"RefreshSeconds": int(s.dashboardRefresh.Seconds()),
+	})
+	if err != nil {
+		log.Printf("rendering dashboard: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboardOrder(t *testing.T) {
+	s := testServer()
+	h := s.Handler()
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := setClock(t, start)
+	s.Checkin("b-1h", checkinSuccess, "", "")
+	*clock = start.Add(time.Minute)
+	s.Checkin("a-1h", checkinSuccess, "", "")
+	s.Checkin("c-1h", checkinSuccess, "", "")
+
+	for target, want := range map[string][]string{
+		"/":             {"a-1h", "b-1h", "c-1h"},
+		"/?sort=since":  {"b-1h", "a-1h", "c-1h"},
+		"/dashboard":    {"a-1h", "b-1h", "c-1h"},
+		"/?sort=status": {"a-1h", "b-1h", "c-1h"},
+	} {
+		r := testRequest("GET", target)
+		r.Header.Set("Accept", "text/html")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		body := w.Body.String()
+		last := -1
+		for _, key := range want {
+			i := strings.Index(body, key)
+			if i < last {
+				t.Errorf("GET %s shows %s out of the order %v", target, key, want)
+			}
+			last = i
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sseKeepalive is how often idle /events streams get a comment, so that
+// proxies don't time them out.
+const sseKeepalive = 15 * time.Second
+
+// statusChange is sent to /events subscribers for every transition.
+type statusChange struct {
+	Key    string    `json:"key"`
+	From   string    `json:"from"`
+	Status string    `json:"status"`
+	At     time.Time `json:"at"`
+}
+
+// hub fans status changes out to the /events subscribers. The zero value is
+// ready to use.
+type hub struct {
+	mu     sync.Mutex
+	subs   map[chan *statusChange]struct{}
+	closed bool
+}
+
+func (h *hub) subscribe() chan *statusChange {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan *statusChange, 64)
+	if h.closed {
+		close(ch)
+		return ch
+	}
+	if h.subs == nil {
+		h.subs = make(map[chan *statusChange]struct{})
+	}
+	h.subs[ch] = struct{}{}
+	return ch
+}
+
+func (h *hub) unsubscribe(ch chan *statusChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// publish never blocks. Subscribers too slow to keep up are disconnected,
+// and can reconnect and reload the statuses.
+func (h *hub) publish(c *statusChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- c:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// close disconnects all subscribers, letting the HTTP server shut down.
+func (h *hub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// eventsHandler streams status changes as server-sent events.
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// the stream outlives the server's write timeout
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // disables nginx buffering
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return // the stream would never end
+	}
+	rc.Flush()
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case c, ok := <-ch:
+			if !ok {
+				return
+			}
+			_, err = fmt.Fprintf(w, "data: %s\n\n", must(json.Marshal(c)))
+		case <-keepalive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+)
+
+// exportHandler returns the whole database in the format of the -f file,
+// e.g. to move it to another instance, see importHandler.
+func (s *Server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	db := s.snapshot(nil)
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="watchdogd-%s.json"`, now().UTC().Format("20060102-150405")))
+	w.Write(must(json.MarshalIndent(db, "", "  ")))
+}
+
+// maxImportSize limits the size of /import bodies, which unlike checkins
+// carry the whole database.
+const maxImportSize = 64 << 20
+
+// importResult tells the client which keys were imported, and why the
+// others weren't.
+type importResult struct {
+	Mode     string         `json:"mode"`
+	Imported int            `json:"imported"`
+	Skipped  []*importError `json:"skipped,omitempty"`
+}
+
+type importError struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// importHandler loads a database returned by /export. With ?mode=merge (the
+// default), keys keep their current data unless the import has a later
+// checkin; with ?mode=replace, the current data is discarded. Keys over
+// -max-keys are skipped.
+func (s *Server) importHandler(w http.ResponseWriter, r *http.Request) {
+	if s.readOnly {
+		httpError(w, errReadOnly)
+		return
+	}
+	mode := cmp.Or(r.URL.Query().Get("mode"), "merge")
+	if mode != "merge" && mode != "replace" {
+		http.Error(w, "Invalid mode, must be merge or replace", http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		bodyError(w, err, "Error reading request body")
+		return
+	}
+	db, err := decodeDatabase(data, "import")
+	if errors.Is(err, errCorrupted) {
+		http.Error(w, "Invalid JSON, expected a database returned by /export", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := &importResult{Mode: mode}
+	s.mu.Lock()
+	if mode == "replace" {
+		for key := range s.checkins {
+			s.deleteKey(key)
+		}
+		for key := range s.intervals {
+			s.deleteKey(key)
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(db.Checkins)) {
+		t := db.Checkins[key]
+		if _, ok := parse(key); !ok && !(validName(key) && db.Intervals[key] != "") {
+			result.Skipped = append(result.Skipped, &importError{Key: key, Error: "invalid key"})
+		} else if t.IsZero() {
+			result.Skipped = append(result.Skipped, &importError{Key: key, Error: "no checkin time"})
+		} else if mode == "merge" && !t.After(s.checkins[key]) {
+			result.Skipped = append(result.Skipped, &importError{Key: key, Error: "not newer"})
+		} else if !s.canAdd(key) {
+			result.Skipped = append(result.Skipped, &importError{Key: key, Error: "too many keys"})
+		} else {
+			s.deleteKey(key)
+			s.importKey(db, key)
+			result.Imported++
+		}
+	}
+	// keys configured with /{key}/config that haven't checked in yet
+	for _, key := range slices.Sorted(maps.Keys(db.Intervals)) {
+		spec := db.Intervals[key]
+		_, exists := s.checkins[key]
+		if _, ok := db.Checkins[key]; ok {
+			continue
+		} else if _, ok := parseSpec(spec); !ok || !validName(key) {
+			result.Skipped = append(result.Skipped, &importError{Key: key, Error: "invalid key"})
+		} else if _, configured := s.intervals[key]; mode == "merge" && (exists || configured) {
+			result.Skipped = append(result.Skipped, &importError{Key: key, Error: "not newer"})
+		} else {
+			s.deleteKey(key)
+			s.metaMu.Lock()
+			s.intervals[key] = spec
+			s.metaMu.Unlock()
+			result.Imported++
+		}
+	}
+	s.mu.Unlock()
+
+	logEvent(slog.LevelInfo, "import", fmt.Sprintf("imported %d keys (%s), skipped %d", result.Imported, mode, len(result.Skipped)),
+		"mode", mode, "imported", result.Imported, "skipped", len(result.Skipped))
+	s.scheduleSave()
+	writeJSON(w, result)
+}
+
+// importKey copies the data of key from db. Must be called with mu held.
+func (s *Server) importKey(db *database, key string) {
+	s.checkins[key] = db.Checkins[key]
+	if v, ok := db.States[key]; ok {
+		s.states[key] = v
+	}
+	if v, ok := db.AlarmSince[key]; ok {
+		s.alarmSince[key] = v
+	}
+	if v, ok := db.StateSince[key]; ok {
+		s.stateSince[key] = v
+	}
+	if v, ok := db.Acks[key]; ok {
+		s.acks[key] = v
+	}
+	if v, ok := db.History[key]; ok {
+		s.history[key] = v
+	}
+	if v, ok := db.Sources[key]; ok {
+		s.sources[key] = v
+	}
+	if v, ok := db.Notes[key]; ok {
+		s.notes[key] = v
+	}
+	if v, ok := db.Starts[key]; ok {
+		s.starts[key] = v
+	}
+	if v, ok := db.Failures[key]; ok {
+		s.failures[key] = v
+	}
+	if v, ok := db.Intervals[key]; ok {
+		s.metaMu.Lock()
+		s.intervals[key] = v
+		s.metaMu.Unlock()
+	}
+	s.markDirty(key)
+}
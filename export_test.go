@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportIntervals(t *testing.T) {
+	checkin := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	setClock(t, checkin)
+	src := newServer()
+	src.Checkin("a-1h", checkinSuccess, "", "")
+	src.intervals["cfg/backup"] = "1d"
+	src.intervals["checked/backup"] = "30m-1h"
+	src.Checkin("checked/backup", checkinSuccess, "", "")
+	export := must(json.Marshal(src.snapshot(nil)))
+
+	for _, mode := range []string{"replace", "merge"} {
+		s := newServer()
+		s.intervals["old/job"] = "1h"
+		r := httptest.NewRequest("POST", "/import?mode="+mode, strings.NewReader(string(export)))
+		w := httptest.NewRecorder()
+		s.importHandler(w, r)
+		var result importResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%s: %v in %s", mode, err, w.Body)
+		}
+		if result.Imported != 3 || len(result.Skipped) != 0 {
+			t.Errorf("%s: got %+v, want 3 keys imported", mode, result)
+		}
+		if lim, ok := s.limits("cfg/backup"); !ok || lim.alarm != 24*time.Hour {
+			t.Errorf("%s: cfg/backup has limits %+v, %v, want its configured 1d", mode, lim, ok)
+		}
+		if _, found := s.checkins["cfg/backup"]; found {
+			t.Errorf("%s: cfg/backup got a checkin", mode)
+		}
+		if s.intervals["checked/backup"] != "30m-1h" || !s.checkins["checked/backup"].Equal(checkin) {
+			t.Errorf("%s: checked/backup lost its interval or checkin", mode)
+		}
+		if _, kept := s.intervals["old/job"]; kept != (mode == "merge") {
+			t.Errorf("%s: old/job kept = %v", mode, kept)
+		}
+		if _, dirty := s.dirty["cfg/backup"]; !dirty {
+			t.Errorf("%s: cfg/backup not saved", mode)
+		}
+	}
+}
+
+func TestImportMaxKeys(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := setClock(t, start)
+	src := newServer()
+	*clock = start.Add(time.Minute)
+	for _, key := range []string{"a-1h", "b-1h", "c-1h"} {
+		src.Checkin(key, checkinSuccess, "", "")
+	}
+	export := must(json.Marshal(src.snapshot(nil)))
+
+	for _, mode := range []string{"replace", "merge"} {
+		s := testServer()
+		st := defaultSettings()
+		st.maxKeys = 2
+		s.current.Store(st)
+		*clock = start
+		s.Checkin("c-1h", checkinSuccess, "", "")
+		w := httptest.NewRecorder()
+		s.importHandler(w, httptest.NewRequest("POST", "/import?mode="+mode, strings.NewReader(string(export))))
+		var result importResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%s: %v in %s", mode, err, w.Body)
+		}
+		want := "b-1h"
+		if mode == "replace" {
+			want = "c-1h"
+		}
+		if result.Imported != 2 || len(result.Skipped) != 1 || result.Skipped[0].Key != want || result.Skipped[0].Error != "too many keys" {
+			t.Errorf("%s: got %+v, want %s skipped as too many keys", mode, result, want)
+		}
+		if len(s.checkins) != 2 {
+			t.Errorf("%s: got %d keys, want 2", mode, len(s.checkins))
+		}
+	}
+}
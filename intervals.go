@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// defaultKeyPattern allows slash-separated keys like team/db/backup-1d.
+const defaultKeyPattern = `[a-zA-Z0-9._-]+(?:/[a-zA-Z0-9._-]+)*`
+
+// nameRe matches the names of keys without their interval suffix, which is
+// the whole name for keys whose limits are set with /{key}/config. See
+// -key-pattern.
+var nameRe atomic.Pointer[regexp.Regexp]
+
+func init() {
+	if err := setKeyPattern(defaultKeyPattern); err != nil {
+		panic(err)
+	}
+}
+
+// setKeyPattern changes the names allowed for keys. Inverse keys add a ~ in
+// front, which isn't part of the pattern.
+func setKeyPattern(pattern string) error {
+	re, err := regexp.Compile(`^~?(?:` + pattern + `)$`)
+	if err != nil {
+		return err
+	}
+	nameRe.Store(re)
+	return nil
+}
+
+// reservedNames can't be keys, since they are taken by other routes.
+var reservedNames = []string{"batch", "dashboard", "events", "export", "import", "metrics", "ping", "status", "version", "ws"}
+
+// actionNames can't be the last segment of keys, see keyRoutes.
+var actionNames = []string{"ack", "alertmanager", "config", "fail", "history", "rename", "sla", "start"}
+
+// validName reports whether key can be configured with /{key}/config.
+func validName(key string) bool {
+	last := key[strings.LastIndexByte(key, '/')+1:]
+	return matchName(key) && !slices.Contains(reservedNames, key) && !slices.Contains(actionNames, last)
+}
+
+// matchName reports whether name is allowed by -key-pattern. Names under
+// ping/ and alertmanager/ are never allowed, since /ping/... are the
+// Healthchecks-style routes and /alertmanager/... the Alertmanager webhooks.
+func matchName(name string) bool {
+	return nameRe.Load().MatchString(name) && !strings.HasPrefix(name, "ping/") && !strings.HasPrefix(name, "alertmanager/")
+}
+
+// interval returns the limits set for key with /{key}/config, in the format
+// of the key names, like 1h or 30m-1h.
+func (s *Server) interval(key string) (string, bool) {
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	spec, ok := s.intervals[key]
+	return spec, ok
+}
+
+// configHandler sets the limits of a key, which then take precedence over
+// the ones in its name: ?interval=45s, optionally with ?warn=30s.
+func (s *Server) configHandler(w http.ResponseWriter, r *http.Request) {
+	if s.readOnly {
+		httpError(w, errReadOnly)
+		return
+	}
+	key := r.PathValue("key")
+	if !validName(key) {
+		httpError(w, errInvalidKey)
+		return
+	}
+	spec := r.URL.Query().Get("interval")
+	if warn := r.URL.Query().Get("warn"); warn != "" {
+		spec = warn + "-" + spec
+	}
+	lim, ok := parseSpec(spec)
+	if !ok || (r.URL.Query().Get("warn") != "" && lim.warn == 0) {
+		http.Error(w, "Invalid interval, must be like 45s, 2h or 1d12h, and longer than warn", http.StatusBadRequest)
+		return
+	}
+	if !s.settings().allowsInterval(lim.alarm) {
+		httpError(w, errIntervalBounds)
+		return
+	}
+
+	s.mu.Lock()
+	s.metaMu.Lock()
+	s.intervals[key] = spec
+	s.metaMu.Unlock()
+	s.markDirty(key)
+	s.mu.Unlock()
+
+	logEvent(slog.LevelInfo, "config", fmt.Sprintf("%s now has interval %s", key, spec), "key", key, "interval", spec)
+	s.scheduleSave()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jwtLeeway       = time.Minute      // allowed clock skew
+	jwksMaxAge      = time.Hour        // refetch the keys this often
+	jwksMinInterval = 30 * time.Second // between refetches for unknown key IDs
+)
+
+var (
+	errJWTMalformed = errors.New("malformed JWT")
+	errJWTSignature = errors.New("invalid JWT signature")
+	errJWTExpired   = errors.New("JWT expired")
+	errJWTAudience  = errors.New("JWT has the wrong audience")
+	errJWTScope     = errors.New("JWT lacks the required scope")
+)
+
+// jwtAlgs maps the supported JWS algorithms to their hashes.
+var jwtAlgs = map[string]crypto.Hash{
+	"HS256": crypto.SHA256, "HS384": crypto.SHA384, "HS512": crypto.SHA512,
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Exp   *float64        `json:"exp"`
+	Nbf   *float64        `json:"nbf"`
+	Aud   json.RawMessage `json:"aud"`   // a string or an array of strings
+	Scope string          `json:"scope"` // space-separated
+	Scp   []string        `json:"scp"`   // the same as an array, used by some IdPs
+}
+
+// jwtEnabled reports whether write tokens are JWTs rather than -t tokens.
+func (st *settings) jwtEnabled() bool {
+	return st.jwtSecret != "" || st.jwksURL != ""
+}
+
+// isWriteToken reports whether token grants write access: a valid JWT in
+// JWT mode, one of the -t tokens otherwise.
+func (s *Server) isWriteToken(token string) bool {
+	st := s.settings()
+	if st.jwtEnabled() {
+		return s.verifyJWT(st, token) == nil
+	}
+	return matchToken(st.authTokens, token) >= 0
+}
+
+// jwtMiddleware only lets through requests bearing a valid JWT.
+func (s *Server) jwtMiddleware(st *settings, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := requestToken(r)
+		if !ok {
+			http.Error(w, "Invalid Authorization format", http.StatusBadRequest)
+			return
+		}
+		if err := s.verifyJWT(st, token); err != nil {
+			unauthorized(w)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// verifyJWT checks the signature, the expiry, the audience and the scope of
+// token.
+func (s *Server) verifyJWT(st *settings, token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errJWTMalformed
+	}
+	var header jwtHeader
+	var claims jwtClaims
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || decodeJWTPart(parts[0], &header) != nil || decodeJWTPart(parts[1], &claims) != nil {
+		return errJWTMalformed
+	}
+	hash, ok := jwtAlgs[header.Alg]
+	if !ok {
+		return fmt.Errorf("unsupported JWT algorithm %q", header.Alg)
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	if st.jwtSecret != "" {
+		// never accept public-key algorithms here, or vice versa below
+		mac := hmac.New(hash.New, []byte(st.jwtSecret))
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		if header.Alg[:2] != "HS" || !hmac.Equal(sig, mac.Sum(nil)) {
+			return errJWTSignature
+		}
+	} else if !slices.ContainsFunc(s.jwks.get(st.jwksURL, header.Kid), func(key crypto.PublicKey) bool {
+		return verifySignature(key, header.Alg, hash, digest, sig)
+	}) {
+		return errJWTSignature
+	}
+
+	now := float64(now().Unix())
+	leeway := jwtLeeway.Seconds()
+	if claims.Exp == nil || now > *claims.Exp+leeway || (claims.Nbf != nil && now < *claims.Nbf-leeway) {
+		return errJWTExpired
+	}
+	if !claims.hasAudience(st.jwtAudience) {
+		return errJWTAudience
+	}
+	if st.jwtScope != "" && !slices.Contains(strings.Fields(claims.Scope), st.jwtScope) && !slices.Contains(claims.Scp, st.jwtScope) {
+		return errJWTScope
+	}
+	return nil
+}
+
+func (c *jwtClaims) hasAudience(aud string) bool {
+	var auds []string
+	if err := json.Unmarshal(c.Aud, &auds); err != nil {
+		var one string
+		json.Unmarshal(c.Aud, &one)
+		auds = []string{one}
+	}
+	return aud != "" && slices.Contains(auds, aud)
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifySignature checks a RS* or ES* signature of digest.
+func verifySignature(key crypto.PublicKey, alg string, hash crypto.Hash, digest, sig []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return alg[:2] == "RS" && rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(sig) != 2*size {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// jwksCache holds the public keys fetched from -jwks-url.
+type jwksCache struct {
+	mu       sync.Mutex
+	url      string
+	keys     map[string][]crypto.PublicKey // by key ID
+	fetched  time.Time
+	fetching chan struct{} // closed when the running fetch is done, if any
+}
+
+// get returns the keys that may have signed a JWT with the given key ID,
+// fetching them if they are stale or the key ID is unknown, e.g. after the
+// IdP rotated its keys. The keys are fetched without holding mu, and only
+// the requests with unknown key IDs wait for them.
+func (c *jwksCache) get(url, kid string) []crypto.PublicKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.url != url {
+		c.url, c.keys, c.fetched = url, nil, time.Time{}
+	}
+	age := time.Since(c.fetched)
+	if _, known := c.keys[kid]; age > jwksMaxAge || (!known && age > jwksMinInterval) {
+		done := c.refresh(url)
+		if !known {
+			c.mu.Unlock()
+			<-done
+			c.mu.Lock()
+		}
+	}
+	if kid == "" {
+		var all []crypto.PublicKey
+		for _, keys := range c.keys {
+			all = append(all, keys...)
+		}
+		return all
+	}
+	return c.keys[kid]
+}
+
+// refresh starts fetching the keys unless a fetch is already running, and
+// returns a channel closed when it's done. Must be called with mu held.
+func (c *jwksCache) refresh(url string) <-chan struct{} {
+	if c.fetching != nil {
+		return c.fetching
+	}
+	done := make(chan struct{})
+	c.fetching = done
+	go func() {
+		keys, err := fetchJWKS(url)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err != nil {
+			logEvent(slog.LevelError, "jwks_failed", fmt.Sprintf("fetching the JWT keys from -jwks-url failed: %v", err), "error", err)
+		} else if c.url == url {
+			c.keys = keys
+		}
+		if c.url == url {
+			c.fetched = time.Now() // also after failures, to not hammer the IdP
+		}
+		c.fetching = nil
+		close(done)
+	}()
+	return done
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`   // RSA
+	E   string `json:"e"`   // RSA
+	Crv string `json:"crv"` // EC
+	X   string `json:"x"`   // EC
+	Y   string `json:"y"`   // EC
+}
+
+var jwkCurves = map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+
+// fetchJWKS downloads a JSON Web Key Set, skipping the keys it can't use.
+func fetchJWKS(url string) (map[string][]crypto.PublicKey, error) {
+	resp, err := webhookClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key := k.publicKey(); key != nil {
+			keys[k.Kid] = append(keys[k.Kid], key)
+		}
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() crypto.PublicKey {
+	b64 := func(s string) *big.Int {
+		data, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(data) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(data)
+	}
+	switch k.Kty {
+	case "RSA":
+		n, e := b64(k.N), b64(k.E)
+		if n == nil || e == nil || !e.IsInt64() {
+			return nil
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		curve, x, y := jwkCurves[k.Crv], b64(k.X), b64(k.Y)
+		if curve == nil || x == nil || y == nil {
+			return nil
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT returns a JWT with the given header and claims, signed by sign.
+func signJWT(t *testing.T, header, claims map[string]any, sign func(input []byte) []byte) string {
+	t.Helper()
+	part := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	input := part(header) + "." + part(claims)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(input)))
+}
+
+func hsSigner(secret string, hash crypto.Hash) func([]byte) []byte {
+	return func(input []byte) []byte {
+		mac := hmac.New(hash.New, []byte(secret))
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+}
+
+func rsSigner(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+	return func(input []byte) []byte {
+		h := crypto.SHA256.New()
+		h.Write(input)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+}
+
+func esSigner(t *testing.T, key *ecdsa.PrivateKey) func([]byte) []byte {
+	return func(input []byte) []byte {
+		h := crypto.SHA256.New()
+		h.Write(input)
+		r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+}
+
+func b64int(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+// jwtCase is a JWT and the result of verifying it: nil, a sentinel error,
+// or any error with anyErr.
+type jwtCase struct {
+	name   string
+	token  string
+	err    error
+	anyErr bool
+}
+
+func checkJWTCases(t *testing.T, s *Server, st *settings, cases []jwtCase) {
+	t.Helper()
+	for _, c := range cases {
+		err := s.verifyJWT(st, c.token)
+		if c.anyErr && err == nil || !c.anyErr && err != c.err {
+			t.Errorf("%s: verifyJWT = %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestVerifyJWTSecret(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	setClock(t, start)
+	s := newServer()
+	st := defaultSettings()
+	st.jwtSecret, st.jwtAudience = "s3cret", "watchdogd"
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs256 := map[string]any{"alg": "HS256", "typ": "JWT"}
+	exp := float64(start.Add(time.Hour).Unix())
+	valid := map[string]any{"exp": exp, "aud": "watchdogd"}
+	with := func(extra map[string]any) map[string]any {
+		claims := map[string]any{"exp": exp, "aud": "watchdogd"}
+		for k, v := range extra {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+	sign := hsSigner("s3cret", crypto.SHA256)
+	tamper := func(token string, claims map[string]any) string {
+		parts := strings.Split(token, ".")
+		data, _ := json.Marshal(claims)
+		parts[1] = base64.RawURLEncoding.EncodeToString(data)
+		return strings.Join(parts, ".")
+	}
+	checkJWTCases(t, s, st, []jwtCase{
+		{name: "HS256", token: signJWT(t, hs256, valid, sign)},
+		{name: "HS512", token: signJWT(t, map[string]any{"alg": "HS512"}, valid, hsSigner("s3cret", crypto.SHA512))},
+		{name: "wrong secret", token: signJWT(t, hs256, valid, hsSigner("other", crypto.SHA256)), err: errJWTSignature},
+		{name: "HS512 signature as HS256", token: signJWT(t, hs256, valid, hsSigner("s3cret", crypto.SHA512)), err: errJWTSignature},
+		{name: "alg none", token: signJWT(t, map[string]any{"alg": "none"}, valid, func([]byte) []byte { return nil }), anyErr: true},
+		{name: "RS256 in secret mode", token: signJWT(t, map[string]any{"alg": "RS256"}, valid, rsSigner(t, rsaKey)), err: errJWTSignature},
+		{name: "tampered claims", token: tamper(signJWT(t, hs256, valid, sign), with(map[string]any{"exp": exp + 3600})), err: errJWTSignature},
+		{name: "two parts", token: "e30.e30", err: errJWTMalformed},
+		{name: "bad base64", token: "e30.e30.!!", err: errJWTMalformed},
+		{name: "no exp", token: signJWT(t, hs256, with(map[string]any{"exp": nil}), sign), err: errJWTExpired},
+		{name: "expired", token: signJWT(t, hs256, with(map[string]any{"exp": float64(start.Add(-2 * time.Minute).Unix())}), sign), err: errJWTExpired},
+		{name: "expired within leeway", token: signJWT(t, hs256, with(map[string]any{"exp": float64(start.Add(-30 * time.Second).Unix())}), sign)},
+		{name: "not yet valid", token: signJWT(t, hs256, with(map[string]any{"nbf": float64(start.Add(2 * time.Minute).Unix())}), sign), err: errJWTExpired},
+		{name: "nbf within leeway", token: signJWT(t, hs256, with(map[string]any{"nbf": float64(start.Add(30 * time.Second).Unix())}), sign)},
+		{name: "no aud", token: signJWT(t, hs256, with(map[string]any{"aud": nil}), sign), err: errJWTAudience},
+		{name: "wrong aud", token: signJWT(t, hs256, with(map[string]any{"aud": "other"}), sign), err: errJWTAudience},
+		{name: "aud array", token: signJWT(t, hs256, with(map[string]any{"aud": []string{"other", "watchdogd"}}), sign)},
+	})
+
+	st.jwtScope = "checkin"
+	checkJWTCases(t, s, st, []jwtCase{
+		{name: "no scope", token: signJWT(t, hs256, valid, sign), err: errJWTScope},
+		{name: "scope", token: signJWT(t, hs256, with(map[string]any{"scope": "read checkin"}), sign)},
+		{name: "other scope", token: signJWT(t, hs256, with(map[string]any{"scope": "read checkins"}), sign), err: errJWTScope},
+		{name: "scp", token: signJWT(t, hs256, with(map[string]any{"scp": []string{"checkin"}}), sign)},
+	})
+}
+
+func TestVerifyJWTKeySet(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	setClock(t, start)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherEC, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := `{"keys": [
+		{"kty": "RSA", "kid": "r1", "use": "sig", "n": "` + b64int(rsaKey.N) + `", "e": "` + b64int(big.NewInt(int64(rsaKey.E))) + `"},
+		{"kty": "EC", "kid": "e1", "crv": "P-256", "x": "` + b64int(ecKey.X) + `", "y": "` + b64int(ecKey.Y) + `"},
+		{"kty": "EC", "kid": "enc", "use": "enc", "crv": "P-256", "x": "` + b64int(otherEC.X) + `", "y": "` + b64int(otherEC.Y) + `"}
+	]}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(jwks))
+	}))
+	defer ts.Close()
+
+	s := newServer()
+	st := defaultSettings()
+	st.jwksURL, st.jwtAudience = ts.URL, "watchdogd"
+	claims := map[string]any{"exp": float64(start.Add(time.Hour).Unix()), "aud": "watchdogd"}
+	header := func(alg, kid string) map[string]any { return map[string]any{"alg": alg, "kid": kid} }
+	checkJWTCases(t, s, st, []jwtCase{
+		{name: "RS256", token: signJWT(t, header("RS256", "r1"), claims, rsSigner(t, rsaKey))},
+		{name: "ES256", token: signJWT(t, header("ES256", "e1"), claims, esSigner(t, ecKey))},
+		{name: "ES256 without kid", token: signJWT(t, header("ES256", ""), claims, esSigner(t, ecKey))},
+		{name: "ES256 by another key", token: signJWT(t, header("ES256", "e1"), claims, esSigner(t, otherEC)), err: errJWTSignature},
+		{name: "encryption key", token: signJWT(t, header("ES256", "enc"), claims, esSigner(t, otherEC)), err: errJWTSignature},
+		{name: "RS256 naming the EC key", token: signJWT(t, header("RS256", "e1"), claims, rsSigner(t, rsaKey)), err: errJWTSignature},
+		// key confusion: the public key used as an HMAC secret
+		{name: "HS256 with the RSA key", token: signJWT(t, header("HS256", "r1"), claims, hsSigner(string(rsaKey.N.Bytes()), crypto.SHA256)), err: errJWTSignature},
+		{name: "HS256 with the JWKS", token: signJWT(t, header("HS256", "r1"), claims, hsSigner(jwks, crypto.SHA256)), err: errJWTSignature},
+	})
+}
+
+func TestJWKSFetchDoesNotBlock(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetches := make(chan struct{}, 10)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches <- struct{}{}
+		if len(fetches) > 1 {
+			<-release // the refetch for the unknown key ID hangs
+		}
+		w.Write([]byte(`{"keys": [{"kty": "EC", "kid": "e1", "crv": "P-256", "x": "` + b64int(ecKey.X) + `", "y": "` + b64int(ecKey.Y) + `"}]}`))
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	s := newServer()
+	st := defaultSettings()
+	st.jwksURL, st.jwtAudience = ts.URL, "watchdogd"
+	claims := map[string]any{"exp": float64(now().Add(time.Hour).Unix()), "aud": "watchdogd"}
+	known := signJWT(t, map[string]any{"alg": "ES256", "kid": "e1"}, claims, esSigner(t, ecKey))
+	unknown := signJWT(t, map[string]any{"alg": "ES256", "kid": "e2"}, claims, esSigner(t, ecKey))
+	if err := s.verifyJWT(st, known); err != nil {
+		t.Fatal(err)
+	}
+
+	s.jwks.mu.Lock()
+	s.jwks.fetched = time.Now().Add(-time.Minute) // allow a refetch
+	s.jwks.mu.Unlock()
+	go s.verifyJWT(st, unknown)
+	for len(fetches) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	verified := make(chan error)
+	go func() { verified <- s.verifyJWT(st, known) }()
+	select {
+	case err := <-verified:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a JWT with a known key ID waited for the JWKS fetch of an unknown one")
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+)
+
+// jsonLogs is set by -log-format json. Plain log.Printf calls still work in
+// that mode, they just end up as records without any extra fields.
+var jsonLogs bool
+
+func setupLogging(format string) error {
+	switch format {
+	case "text":
+	case "json":
+		jsonLogs = true
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	default:
+		return fmt.Errorf("invalid -log-format %q, must be text or json", format)
+	}
+	return nil
+}
+
+// logEvent logs a notable event. In JSON mode the event name and attrs become
+// fields of the record; in text mode only msg is printed.
+func logEvent(level slog.Level, event, msg string, attrs ...any) {
+	if jsonLogs {
+		slog.Log(context.Background(), level, msg, append([]any{"event", event}, attrs...)...)
+	} else {
+		log.Print(msg)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPendingMail bounds the number of undelivered emails kept for retrying
+// while the SMTP server is unreachable.
+const maxPendingMail = 100
+
+func (s *Server) mailEnabled(ev *event) bool {
+	st := s.settings()
+	return st.smtpHost != "" && st.destination(ev.Key).mailTo != ""
+}
+
+func (s *Server) sendMail(ev *event) error {
+	var subject, body string
+	last := ev.LastCheckin.Format(time.RFC3339)
+	switch ev.Event {
+	case eventWarn:
+		subject = fmt.Sprintf("[watchdog] %s WARN", ev.Key)
+		body = fmt.Sprintf("Key %s is WARN, approaching its deadline.\r\n\r\nLast checkin: %s\r\nPast the warning threshold by: %s\r\n", ev.Key, last, time.Duration(ev.OverdueSeconds)*time.Second)
+	case eventAlarm:
+		subject = fmt.Sprintf("[watchdog] %s DOWN", ev.Key)
+		body = fmt.Sprintf("Key %s is DOWN.\r\n\r\nLast checkin: %s\r\nOverdue by: %s\r\n", ev.Key, last, time.Duration(ev.OverdueSeconds)*time.Second)
+		if ev.Failed {
+			subject = fmt.Sprintf("[watchdog] %s FAILED", ev.Key)
+			body = fmt.Sprintf("Key %s is DOWN: the run reported a failure.\r\n\r\nFailed at: %s\r\n", ev.Key, last)
+		}
+		if ev.Reminder > 0 {
+			subject = strings.Replace(subject, "] "+ev.Key+" ", "] "+ev.Key+" still ", 1)
+			body = strings.Replace(body, "is DOWN", "is still DOWN", 1)
+		}
+	case eventRecovery:
+		subject = fmt.Sprintf("[watchdog] %s RECOVERED", ev.Key)
+		body = fmt.Sprintf("Key %s is back UP.\r\n\r\nLast checkin: %s\r\nWas in alarm for: %s\r\n", ev.Key, last, time.Duration(ev.AlarmSeconds)*time.Second)
+	default:
+		return nil
+	}
+	if ev.Suppressed > 0 {
+		body += fmt.Sprintf("Changes during the cooldown: %d\r\n", ev.Suppressed)
+	}
+
+	st := s.settings()
+	to := splitList(st.destination(ev.Key).mailTo)
+	if len(to) == 0 {
+		return nil // no longer routed to email since a reload
+	}
+	from := st.mailFrom
+	if from == "" {
+		from = "watchdogd@" + st.smtpHost
+	}
+
+	var auth smtp.Auth
+	if st.smtpUser != "" {
+		auth = smtp.PlainAuth("", st.smtpUser, st.smtpPass, st.smtpHost)
+	}
+	addr := net.JoinHostPort(st.smtpHost, strconv.Itoa(st.smtpPort))
+	return sendSMTP(addr, st.smtpHost, auth, from, to, mailMessage(from, to, subject, body))
+}
+
+// mailMessage formats an email. The subject has the key in it, so it's
+// encoded as needed to keep a key with a line break from adding headers.
+func mailMessage(from string, to []string, subject, body string) []byte {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "\r\n%s", body)
+	return []byte(msg.String())
+}
+
+// smtpTimeout bounds a whole delivery, since a hung SMTP server would
+// otherwise hold up all other notifications.
+const smtpTimeout = 30 * time.Second
+
+// sendSMTP is smtp.SendMail with a timeout.
+func sendSMTP(addr, host string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMailMessageHeaders(t *testing.T) {
+	setClock(t, time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	msg := string(mailMessage("wd@example.com", []string{"a@example.com", "b@example.com"}, "[watchdog] evil\r\nBcc: x@example.com DOWN", "Key evil is DOWN.\r\n"))
+	headers, body, _ := strings.Cut(msg, "\r\n\r\n")
+	for _, line := range strings.Split(headers, "\r\n") {
+		name, _, _ := strings.Cut(line, ":")
+		switch name {
+		case "From", "To", "Subject", "Date", "Content-Type":
+		default:
+			t.Errorf("unexpected header line %q", line)
+		}
+	}
+	if !strings.Contains(headers, "Date: Thu, 01 Jan 2026 12:00:00 +0000") {
+		t.Errorf("headers %q lack the Date from now()", headers)
+	}
+	if body != "Key evil is DOWN.\r\n" {
+		t.Errorf("body = %q", body)
+	}
+
+	msg = string(mailMessage("wd@example.com", []string{"a@example.com"}, "[watchdog] backup-1d DOWN", ""))
+	if !strings.Contains(msg, "\r\nSubject: [watchdog] backup-1d DOWN\r\n") {
+		t.Errorf("plain subject got encoded in %q", msg)
+	}
+}
+
+// fakeSMTP accepts a single email and returns its data.
+func fakeSMTP(t *testing.T) (addr string, data <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ch := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tc := textproto.NewConn(conn)
+		tc.PrintfLine("220 fake")
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd, _, _ := strings.Cut(line, " "); strings.ToUpper(cmd) {
+			case "DATA":
+				tc.PrintfLine("354 go ahead")
+				lines, _ := tc.ReadDotLines()
+				ch <- strings.Join(lines, "\n")
+				tc.PrintfLine("250 ok")
+			case "QUIT":
+				tc.PrintfLine("221 bye")
+				return
+			default:
+				tc.PrintfLine("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String(), ch
+}
+
+func TestSendSMTP(t *testing.T) {
+	addr, data := fakeSMTP(t)
+	if err := sendSMTP(addr, "127.0.0.1", nil, "wd@example.com", []string{"a@example.com"}, []byte("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-data; got != "Subject: hi\n\nhello" {
+		t.Errorf("server got %q", got)
+	}
+}
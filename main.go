@@ -1,188 +1,2380 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"context"
 	"crypto/rand"
 	"crypto/subtle"
+	"crypto/tls"
 	"encoding/base32"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"log/slog"
 	"maps"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+// Formats of the time since the last checkin in the text output.
+const (
+	sinceUnits    = "units"    // 2h 5m 3s
+	sinceRelative = "relative" // 2 hours ago
+)
+
+// maxNoteLen is the maximum size of a checkin note.
+const maxNoteLen = 1024
+
+// socketMode lets the owner and the group (e.g. the reverse proxy) connect
+// to the unix socket.
+const socketMode = 0660
+
+// Kinds of checkins. A start resets the timer like a success does, and
+// marks the run as in progress; a failure puts the key into ALARM until the
+// next success.
+const (
+	checkinSuccess = "success"
+	checkinStart   = "start"
+	checkinFail    = "fail"
+)
+
+const (
+	statusOkay  = "OKAY"
+	statusAlarm = "ALARM"
+	statusNever = "NEVER"
+	statusAcked = "ACKED"
+	statusWarn  = "WARN"
+	statusLate  = "LATE" // overdue, but within the grace period of the key
 )
 
 var (
-	authToken string
-	filename  string
-	mu        sync.Mutex
-	checkins  = make(map[string]time.Time)
-	keyRe     = regexp.MustCompile(`^[a-zA-Z0-9._-]+-(\d+[hms])$`)
+	now = time.Now // replaced by tests to control the clock
+
+	// keyRe matches the interval suffix of keys, like -1h or -30m-1h.
+	keyRe = regexp.MustCompile(`-((?:\d+(?:ms|[smhdw]))+)(?:-((?:\d+(?:ms|[smhdw]))+))?$`)
 )
 
-func load() {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		if os.IsNotExist(err) {
-			log.Printf("no watchdogd database file found, starting with an empty database.")
+var (
+	errInvalidKey      = errors.New("invalid key")
+	errTooManyKeys     = errors.New("too many keys")
+	errIntervalBounds  = errors.New("interval out of bounds")
+	errTooManyCheckins = errors.New("too many checkins")
+	errNoteTooLong     = errors.New("note too long")
+	errInverseKind     = errors.New("inverse keys only take plain checkins")
+	errKeyNotFound     = errors.New("key not found")
+	errKeyExists       = errors.New("key already exists")
+	errInvalidDuration = errors.New("invalid duration")
+	errReadOnly        = errors.New("read-only instance")
+)
+
+// Server is a watchdogd instance: the keys, their state and the HTTP API
+// to them. The configuration fields must be set before Start.
+type Server struct {
+	store            Store
+	current          atomic.Pointer[settings]
+	checkInterval    time.Duration
+	saveInterval     time.Duration
+	historySize      int
+	maxBodySize      int64 // of checkin requests
+	dashboardRefresh time.Duration
+	startupGrace     time.Duration // see inStartupGrace
+	s3               *s3Backup     // optional off-site copy of the database
+	backupInterval   time.Duration
+	pushURL          string // of the Pushgateway to push the metrics to
+	pushJob          string
+	pushInterval     time.Duration
+	statsd           *statsdClient // optional
+	statsdInterval   time.Duration
+	trustProxy       bool           // take client addresses from X-Forwarded-For
+	readOnly         bool           // refuse checkins, acks and deletes, never save
+	sinceFormat      string         // sinceUnits or sinceRelative
+	location         *time.Location // for displaying times
+
+	mu         sync.RWMutex         // read-only handlers only take RLock
+	checkins   map[string]time.Time // wall clock times, see statusOf
+	states     map[string]string
+	alarmSince map[string]time.Time
+	stateSince map[string]time.Time   // when the keys entered their states
+	acks       map[string]time.Time   // alarms are silenced until these times
+	history    map[string][]time.Time // recent checkins, oldest first
+	sources    map[string]string      // address of the last checkin
+	notes      map[string]string      // note sent with the last checkin
+	starts     map[string]time.Time   // runs in progress, cleared by the next success or failure
+	failures   map[string]time.Time   // failed runs, cleared by the next success
+	dirty      map[string]struct{}    // keys changed since the last save
+	reminders  map[string]reminder    // keys in ALARM, see remind
+	held       map[string]*event      // notifications held back by maintenance windows
+	startedAt  time.Time
+
+	metaMu    sync.RWMutex      // guards intervals, which limits reads without mu; written with mu held
+	intervals map[string]string // limits set with /{key}/config, see interval
+
+	saveMu       sync.Mutex // serializes store.Save calls
+	storeDown    bool       // the store is unavailable, guarded by saveMu
+	backupMu     sync.Mutex // serializes backups
+	saveRequests chan struct{}
+
+	// notifications are delivered by a single goroutine, so that the events
+	// for a key arrive in the order they happened.
+	notifications chan *event
+	webhooks      []*delivery // pending webhook retries, only accessed by the notifier
+	events        hub         // status changes for /events
+	jwks          jwksCache
+
+	bucketsMu sync.Mutex
+	buckets   map[string]*bucket
+
+	evaluated atomic.Int64 // Unix nanoseconds of the last evaluator tick, see sdWatchdog
+}
+
+// settings is the part of the configuration that can be changed while the
+// server is running, see Reload. It must not be modified once in use.
+type settings struct {
+	authTokens      []string          `flag:"t"`
+	keyTokens       map[string]string `flag:"key-tokens"` // per-key checkin tokens
+	keyGrace        map[string]grace  `flag:"config"`     // per-key grace periods
+	readToken       string            `flag:"read-token"`
+	metricsToken    string            `flag:"metrics-token"`
+	jwtSecret       string            `flag:"jwt-secret"` // write tokens are JWTs signed with it
+	jwksURL         string            `flag:"jwks-url"`   // or with the keys published there
+	jwtAudience     string            `flag:"jwt-audience"`
+	jwtScope        string            `flag:"jwt-scope"`
+	webhookURL      string            `flag:"webhook"`
+	webhookSecret   string            `flag:"webhook-secret"`
+	slackWebhookURL string            `flag:"slack-webhook"`
+	smtpHost        string            `flag:"smtp-host"`
+	smtpPort        int               `flag:"smtp-port"`
+	smtpUser        string            `flag:"smtp-user"`
+	smtpPass        string            `flag:"smtp-pass"`
+	mailFrom        string            `flag:"mail-from"`
+	mailTo          string            `flag:"mail-to"`
+	routes          []route           `flag:"config"` // per-key notification destinations, see destination
+	maintenance     []window          `flag:"config"` // when alarms of some keys don't notify
+	execCommand     string            `flag:"exec"`
+	execTimeout     time.Duration     `flag:"exec-timeout"`
+	renotifyAfter   time.Duration     `flag:"renotify-after"`  // 0 notifies about an alarm only once
+	renotifyMax     int               `flag:"renotify-max"`    // 0 means no limit
+	notifyCooldown  time.Duration     `flag:"notify-cooldown"` // minimum time between the notifications about a key
+	webhookAttempts int               `flag:"webhook-attempts"`
+	webhookBackoff  time.Duration     `flag:"webhook-backoff"` // before the first retry, doubled for every next one
+	gcAfter         time.Duration     `flag:"gc-after"`        // forget keys without checkins for this long
+	maxKeys         int               `flag:"max-keys"`        // refuse checkins of new keys above this many
+	minInterval     time.Duration     `flag:"min-interval"`    // refuse checkins of keys with shorter alarm thresholds
+	maxInterval     time.Duration     `flag:"max-interval"`    // or longer ones, 0 means no limit
+	checkinRate     float64           `flag:"checkin-rate"`    // checkins per second allowed per key, 0 disables limiting
+	checkinBurst    int               `flag:"checkin-burst"`
+	corsOrigins     []string          `flag:"cors-origin"` // origins allowed to read the status endpoints
+}
+
+func defaultSettings() *settings {
+	return &settings{
+		smtpPort:        587,
+		execTimeout:     30 * time.Second,
+		checkinBurst:    10,
+		notifyCooldown:  5 * time.Minute,
+		webhookAttempts: 5,
+		webhookBackoff:  time.Second,
+	}
+}
+
+// newServer returns a server with no keys and the default configuration.
+func newServer() *Server {
+	s := &Server{
+		checkInterval:    10 * time.Second,
+		saveInterval:     time.Second,
+		historySize:      20,
+		maxBodySize:      64 << 10,
+		backupInterval:   time.Hour,
+		pushJob:          "watchdogd",
+		pushInterval:     30 * time.Second,
+		statsdInterval:   10 * time.Second,
+		dashboardRefresh: 30 * time.Second,
+		sinceFormat:      sinceUnits,
+		location:         time.UTC,
+
+		checkins:      make(map[string]time.Time),
+		states:        make(map[string]string),
+		alarmSince:    make(map[string]time.Time),
+		stateSince:    make(map[string]time.Time),
+		acks:          make(map[string]time.Time),
+		history:       make(map[string][]time.Time),
+		sources:       make(map[string]string),
+		notes:         make(map[string]string),
+		starts:        make(map[string]time.Time),
+		failures:      make(map[string]time.Time),
+		dirty:         make(map[string]struct{}),
+		reminders:     make(map[string]reminder),
+		held:          make(map[string]*event),
+		intervals:     make(map[string]string),
+		startedAt:     now(),
+		saveRequests:  make(chan struct{}, 1),
+		notifications: make(chan *event, 1000),
+		buckets:       make(map[string]*bucket),
+	}
+	s.current.Store(defaultSettings())
+	return s
+}
+
+// settings returns the current reloadable settings.
+func (s *Server) settings() *settings {
+	return s.current.Load()
+}
+
+// Start runs the background goroutines that evaluate the keys, deliver
+// notifications and save the database.
+func (s *Server) Start() {
+	go s.saver()
+	go s.notifier()
+	s.evaluated.Store(time.Now().UnixNano()) // as if the evaluator had just ticked
+	go s.evaluator()
+	if s.s3 != nil {
+		go s.backuper()
+	}
+	if s.pushURL != "" {
+		go s.pusher()
+	}
+	if s.statsd != nil {
+		go s.statsdEmitter()
+	}
+}
+
+func (s *Server) load() {
+	var db *database
+	err := fs.ErrNotExist
+	if s.store != nil {
+		db, err = s.store.Load()
+	}
+	restored := false
+	if errors.Is(err, fs.ErrNotExist) && s.s3 != nil {
+		db, err = s.s3.download()
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			// starting empty would overwrite the backup
+			log.Fatalf("error restoring watchdogd database from %v: %v", s.s3, err)
+		}
+		restored = err == nil
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("no watchdogd database found, starting with an empty database.")
+		return
+	} else if errors.Is(err, errCorrupted) {
+		log.Printf("corrupted watchdogd database, starting with an empty database.")
+		return
+	} else if errors.Is(err, errStoreUnavailable) {
+		log.Printf("%v, starting with an empty database until it's back.", err)
+		s.storeDown = true
+		return
+	} else if err != nil {
+		log.Fatalf("error loading watchdogd database: %v", err)
+	}
+	if db.Checkins != nil {
+		s.checkins = db.Checkins
+	}
+	if db.States != nil {
+		s.states = db.States
+	}
+	if db.AlarmSince != nil {
+		s.alarmSince = db.AlarmSince
+	}
+	if db.StateSince != nil {
+		s.stateSince = db.StateSince
+	}
+	if db.Acks != nil {
+		s.acks = db.Acks
+	}
+	if db.History != nil {
+		s.history = db.History
+	}
+	if db.Sources != nil {
+		s.sources = db.Sources
+	}
+	if db.Notes != nil {
+		s.notes = db.Notes
+	}
+	if db.Starts != nil {
+		s.starts = db.Starts
+	}
+	if db.Failures != nil {
+		s.failures = db.Failures
+	}
+	if db.Intervals != nil {
+		s.intervals = db.Intervals
+	}
+	if restored {
+		log.Printf("restored watchdogd database from %v.", s.s3)
+		for key := range s.checkins {
+			s.markDirty(key)
+		}
+		for key := range s.intervals {
+			s.markDirty(key)
+		}
+		s.scheduleSave()
+	}
+}
+
+// markDirty records that key needs saving. Must be called with mu held.
+func (s *Server) markDirty(key string) {
+	s.dirty[key] = struct{}{}
+}
+
+// scheduleSave asks saver to write the database soon. Multiple requests made
+// while a save is pending are coalesced into a single write.
+func (s *Server) scheduleSave() {
+	select {
+	case s.saveRequests <- struct{}{}:
+	default:
+	}
+}
+
+// saver performs all scheduled saves, at most once per saveInterval.
+func (s *Server) saver() {
+	for range s.saveRequests {
+		s.save()
+		time.Sleep(s.saveInterval)
+	}
+}
+
+// save writes the keys changed since the last save, or the whole database
+// for the stores that can't save keys separately. Handlers don't call it, but
+// markDirty and scheduleSave instead, so it only runs in saver and once more
+// at shutdown, and saveMu keeps even these from overlapping: the snapshot is
+// taken with saveMu held, so the writes also happen in order.
+func (s *Server) save() {
+	if s.store == nil || s.readOnly {
+		// a read-only standby usually shares the store with the primary
+		return
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	inc, incremental := s.store.(incrementalStore)
+
+	s.mu.Lock()
+	if len(s.dirty) == 0 {
+		// e.g. the second of the saves scheduled by a checkin and the
+		// transition it caused
+		s.mu.Unlock()
+		return
+	}
+	keys := slices.Collect(maps.Keys(s.dirty))
+	var db *database
+	if incremental {
+		db = s.snapshot(keys)
+	} else {
+		db = s.snapshot(nil)
+	}
+	clear(s.dirty)
+	s.mu.Unlock()
+
+	var err error
+	if incremental {
+		err = inc.SaveKeys(db, keys)
+	} else {
+		err = s.store.Save(db)
+	}
+	if errors.Is(err, errStoreUnavailable) {
+		s.mu.Lock()
+		for _, key := range keys {
+			s.markDirty(key)
+		}
+		s.mu.Unlock()
+		s.scheduleSave()
+	}
+	if s.checkStore(err) != nil {
+		logEvent(slog.LevelError, "save_failed", fmt.Sprintf("watchdogd saving failed: %v", err), "error", err)
+		os.Exit(1)
+	}
+}
+
+// checkStore logs the store becoming unavailable and coming back, and returns
+// err unless it's errStoreUnavailable. Must be called with saveMu held.
+func (s *Server) checkStore(err error) error {
+	if errors.Is(err, errStoreUnavailable) {
+		if !s.storeDown {
+			logEvent(slog.LevelError, "store_unavailable", fmt.Sprintf("%v, serving in-memory data and retrying", err), "error", err)
+			s.storeDown = true
+		}
+		return nil
+	}
+	if err == nil && s.storeDown {
+		logEvent(slog.LevelInfo, "store_available", "database is available again")
+		s.storeDown = false
+		// there's no telling what the store kept meanwhile, so save everything
+		s.mu.Lock()
+		for key := range s.checkins {
+			s.markDirty(key)
+		}
+		s.mu.Unlock()
+		s.scheduleSave()
+	}
+	return err
+}
+
+// refresh merges in the changes other servers have made to a shared store:
+// later checkins and acks, and deleted keys. States are not merged, since
+// every server evaluates the keys on its own.
+func (s *Server) refresh() {
+	// holding saveMu guarantees that all keys not marked dirty are saved
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	db, err := s.store.Load()
+	if errors.Is(err, fs.ErrNotExist) {
+		db, err = &database{}, nil
+	}
+	if err = s.checkStore(err); err != nil {
+		logEvent(slog.LevelError, "refresh_failed", fmt.Sprintf("watchdogd reloading the database failed: %v", err), "error", err)
+	}
+	if err != nil || s.storeDown {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.checkins {
+		if _, dirty := s.dirty[key]; !dirty && db.Checkins[key].IsZero() {
+			s.deleteKey(key)
+			delete(s.dirty, key) // already deleted from the store
+		}
+	}
+	for key, t := range db.Checkins {
+		if !t.After(s.checkins[key]) {
+			continue
+		}
+		s.checkins[key] = t
+		if h, ok := db.History[key]; ok {
+			s.history[key] = h
+		} else {
+			delete(s.history, key)
+		}
+		if addr, ok := db.Sources[key]; ok {
+			s.sources[key] = addr
+		} else {
+			delete(s.sources, key)
+		}
+		if note, ok := db.Notes[key]; ok {
+			s.notes[key] = note
+		} else {
+			delete(s.notes, key)
+		}
+		if t, ok := db.Starts[key]; ok {
+			s.starts[key] = t
+		} else {
+			delete(s.starts, key)
+		}
+		if t, ok := db.Failures[key]; ok {
+			s.failures[key] = t
+		} else {
+			delete(s.failures, key)
+		}
+	}
+	for key, until := range db.Acks {
+		if until.After(s.acks[key]) {
+			s.acks[key] = until
+		}
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	for key := range s.intervals {
+		if _, dirty := s.dirty[key]; !dirty {
+			delete(s.intervals, key)
+		}
+	}
+	for key, spec := range db.Intervals {
+		if _, dirty := s.dirty[key]; !dirty {
+			s.intervals[key] = spec
+		}
+	}
+}
+
+// snapshot copies the given keys, or the entire database if keys is nil.
+// Must be called with mu held.
+func (s *Server) snapshot(keys []string) *database {
+	if keys == nil {
+		db := &database{
+			Version:    dbVersion,
+			Checkins:   maps.Clone(s.checkins),
+			States:     maps.Clone(s.states),
+			AlarmSince: maps.Clone(s.alarmSince),
+			StateSince: maps.Clone(s.stateSince),
+			Acks:       maps.Clone(s.acks),
+			History:    make(map[string][]time.Time, len(s.history)),
+		}
+		for key, h := range s.history {
+			db.History[key] = slices.Clone(h)
+		}
+		db.Sources = maps.Clone(s.sources)
+		db.Notes = maps.Clone(s.notes)
+		db.Starts = maps.Clone(s.starts)
+		db.Failures = maps.Clone(s.failures)
+		db.Intervals = maps.Clone(s.intervals)
+		return db
+	}
+	db := &database{
+		Version:    dbVersion,
+		Checkins:   make(map[string]time.Time),
+		States:     make(map[string]string),
+		AlarmSince: make(map[string]time.Time),
+		StateSince: make(map[string]time.Time),
+		Acks:       make(map[string]time.Time),
+		History:    make(map[string][]time.Time),
+		Sources:    make(map[string]string),
+		Notes:      make(map[string]string),
+		Starts:     make(map[string]time.Time),
+		Failures:   make(map[string]time.Time),
+		Intervals:  make(map[string]string),
+	}
+	for _, key := range keys {
+		if v, ok := s.checkins[key]; ok {
+			db.Checkins[key] = v
+		}
+		if v, ok := s.states[key]; ok {
+			db.States[key] = v
+		}
+		if v, ok := s.alarmSince[key]; ok {
+			db.AlarmSince[key] = v
+		}
+		if v, ok := s.stateSince[key]; ok {
+			db.StateSince[key] = v
+		}
+		if v, ok := s.acks[key]; ok {
+			db.Acks[key] = v
+		}
+		if v, ok := s.history[key]; ok {
+			db.History[key] = slices.Clone(v)
+		}
+		if v, ok := s.sources[key]; ok {
+			db.Sources[key] = v
+		}
+		if v, ok := s.starts[key]; ok {
+			db.Starts[key] = v
+		}
+		if v, ok := s.failures[key]; ok {
+			db.Failures[key] = v
+		}
+		if v, ok := s.notes[key]; ok {
+			db.Notes[key] = v
+		}
+		if v, ok := s.intervals[key]; ok {
+			db.Intervals[key] = v
+		}
+	}
+	return db
+}
+
+// limits are the thresholds of a key: WARN after warn (if non-zero), LATE
+// after alarm, and ALARM after alarm plus grace.
+type limits struct {
+	warn    time.Duration
+	alarm   time.Duration
+	grace   time.Duration // from the config, see Server.limits
+	inverse bool          // ALARM while the last checkin is within alarm, see parse
+}
+
+// parse determines the limits of a key from its suffix: either -ALARM, or
+// -WARN-ALARM with WARN shorter than ALARM. If the latter doesn't hold, the
+// first duration is treated as a part of the name, like before two-tier keys.
+// Keys starting with ~ are inverse: they are in ALARM while they have checked
+// in within the duration, e.g. ~errors-1h alarms if errors were reported
+// during the last hour.
+func parse(key string) (limits, bool) {
+	lim, ok := parseLimits(key)
+	return invert(key, lim), ok
+}
+
+// invert turns lim into the limits of an inverse key, if key is one.
+func invert(key string, lim limits) limits {
+	if strings.HasPrefix(key, "~") {
+		// Inverse keys have no use for a warning threshold.
+		lim.warn, lim.inverse = 0, true
+	}
+	return lim
+}
+
+// limits returns the limits of key, preferring the ones set with
+// /{key}/config to the ones in its name, with the grace period configured
+// for it.
+func (s *Server) limits(key string) (limits, bool) {
+	lim, ok := parse(key)
+	if spec, found := s.interval(key); found {
+		lim, ok = parseSpec(spec)
+		lim = invert(key, lim)
+	}
+	if ok && !lim.inverse {
+		lim.grace = s.settings().keyGrace[key].of(lim.alarm)
+	}
+	return lim, ok
+}
+
+func parseLimits(key string) (limits, bool) {
+	// the leftmost match, so foo-30m-1h has both thresholds
+	m := keyRe.FindStringSubmatchIndex(key)
+	if m == nil || !matchName(key[:m[0]]) {
+		return limits{}, false
+	}
+	return parseSpec(key[m[2]:max(m[3], m[5])])
+}
+
+// parseSpec parses the limits part of a key name, like 1h or 30m-1h.
+func parseSpec(spec string) (limits, bool) {
+	a, b, two := strings.Cut(spec, "-")
+	first, ok := parseInterval(a)
+	if !ok {
+		return limits{}, false
+	}
+	if !two {
+		return limits{alarm: first}, true
+	}
+	second, ok := parseInterval(b)
+	if !ok {
+		return limits{}, false
+	}
+	if first < second {
+		return limits{warn: first, alarm: second}, true
+	}
+	return limits{alarm: second}, true
+}
+
+var intervalUnits = map[string]time.Duration{
+	"w":  7 * 24 * time.Hour,
+	"d":  24 * time.Hour,
+	"h":  time.Hour,
+	"m":  time.Minute,
+	"s":  time.Second,
+	"ms": time.Millisecond,
+}
+
+// parseInterval parses a sequence of numbers followed by units, like 1h30m.
+// Unlike time.ParseDuration, it supports days (d) and weeks (w), and requires
+// each unit to appear at most once, largest first. Note that m is minutes,
+// and milliseconds are ms, so 500m is over 8 hours while 500ms is half a
+// second. Zero intervals like 0s are invalid.
+func parseInterval(s string) (time.Duration, bool) {
+	var total time.Duration
+	prev := time.Duration(math.MaxInt64)
+	for s != "" {
+		i := 0
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		if i == 0 || i == len(s) {
+			return 0, false
+		}
+		j := i + 1
+		if strings.HasPrefix(s[i:], "ms") {
+			j++
+		}
+		unit, ok := intervalUnits[s[i:j]]
+		if !ok || unit >= prev {
+			return 0, false
+		}
+		n, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil || n > int64((math.MaxInt64-total)/unit) {
+			return 0, false
+		}
+		total += time.Duration(n) * unit
+		prev = unit
+		s = s[j:]
+	}
+	return total, total > 0
+}
+
+// keyStatus is the status of a single key, as reported by the status
+// endpoints.
+type keyStatus struct {
+	Key              string     `json:"key"`
+	LastCheckin      *time.Time `json:"last_checkin,omitempty"`
+	SinceSeconds     *int64     `json:"since_seconds,omitempty"`
+	RemainingSeconds *int64     `json:"remaining_seconds,omitempty"` // negative when overdue; until the alarm clears for inverse keys
+	AlarmAt          *time.Time `json:"alarm_at,omitempty"`          // when the key goes into ALARM without further checkins; not for inverse keys
+	Status           string     `json:"status"`
+	ThresholdSeconds int64      `json:"threshold_seconds"`
+	WarnSeconds      int64      `json:"warn_threshold_seconds,omitempty"`
+	GraceSeconds     int64      `json:"grace_seconds,omitempty"`
+	Inverse          bool       `json:"inverse,omitempty"`
+	MissedIntervals  int64      `json:"missed_intervals,omitempty"` // whole thresholds since the last checkin, 0 while OKAY
+
+	StateSince           *time.Time `json:"state_since,omitempty"` // when the key entered its status, if known
+	StateDurationSeconds *int64     `json:"state_duration_seconds,omitempty"`
+
+	AckedUntil          *time.Time `json:"acked_until,omitempty"`
+	AckRemainingSeconds int64      `json:"ack_remaining_seconds,omitempty"`
+
+	Source string `json:"source,omitempty"` // address of the last checkin
+	Note   string `json:"note,omitempty"`
+	State  string `json:"state,omitempty"` // started while a run is in progress, failed after a failure
+
+	lastCheckin   time.Time
+	since         time.Duration
+	remaining     time.Duration
+	ackRemaining  time.Duration
+	stateDuration time.Duration
+}
+
+// entry is everything stored about a key that goes into its status.
+type entry struct {
+	lastCheckin time.Time
+	ackedUntil  time.Time
+	source      string
+	note        string
+	startedAt   time.Time // zero unless a run is in progress
+	failedAt    time.Time // zero unless the last run failed
+}
+
+// entryOf returns the stored data of key. Must be called with mu held.
+func (s *Server) entryOf(key string) entry {
+	return entry{
+		lastCheckin: s.checkins[key],
+		ackedUntil:  s.acks[key],
+		source:      s.sources[key],
+		note:        s.notes[key],
+		startedAt:   s.starts[key],
+		failedAt:    s.failures[key],
+	}
+}
+
+// entries returns the stored data of all keys. Must be called with mu held.
+func (s *Server) entries() map[string]entry {
+	m := make(map[string]entry, len(s.checkins))
+	for key := range s.checkins {
+		m[key] = s.entryOf(key)
+	}
+	return m
+}
+
+func statusOf(key string, lim limits, e entry, now time.Time) *keyStatus {
+	st := &keyStatus{
+		Key:              key,
+		Status:           statusAt(lim, e, now),
+		ThresholdSeconds: int64(lim.alarm.Seconds()),
+		WarnSeconds:      int64(lim.warn.Seconds()),
+		GraceSeconds:     int64(lim.grace.Seconds()),
+		Inverse:          lim.inverse,
+		Source:           e.source,
+		Note:             e.note,
+		lastCheckin:      e.lastCheckin,
+	}
+	switch {
+	case !e.failedAt.IsZero():
+		st.State = "failed"
+	case !e.startedAt.IsZero():
+		st.State = "started"
+	}
+	if !e.lastCheckin.IsZero() {
+		// Checkin times are persisted, so they are compared using the wall
+		// clock (stored times carry no monotonic reading). When the clock
+		// steps back, a checkin can appear to be in the future; treat it
+		// as having just happened rather than reporting a negative age.
+		st.since = max(0, now.Sub(e.lastCheckin))
+		st.remaining = lim.alarm - st.since
+		secs, remaining := int64(st.since.Seconds()), int64(st.remaining.Seconds())
+		st.LastCheckin, st.SinceSeconds, st.RemainingSeconds = &e.lastCheckin, &secs, &remaining
+		if !lim.inverse {
+			alarmAt := e.lastCheckin.Add(lim.alarm + lim.grace)
+			st.AlarmAt = &alarmAt
+			if st.Status != statusOkay && lim.alarm > 0 {
+				st.MissedIntervals = int64(st.since / lim.alarm)
+			}
+		}
+	}
+	if e.ackedUntil.After(now) {
+		st.ackRemaining = e.ackedUntil.Sub(now)
+		st.AckedUntil, st.AckRemainingSeconds = &e.ackedUntil, int64(st.ackRemaining.Seconds())
+	}
+	return st
+}
+
+func statusAt(lim limits, e entry, now time.Time) string {
+	if lim.inverse {
+		if e.lastCheckin.IsZero() || now.Sub(e.lastCheckin) > lim.alarm {
+			return statusOkay
+		}
+		if e.ackedUntil.After(now) {
+			return statusAcked
+		}
+		return statusAlarm
+	}
+	if e.lastCheckin.IsZero() {
+		return statusNever
+	}
+	if !e.failedAt.IsZero() {
+		if e.ackedUntil.After(now) {
+			return statusAcked
+		}
+		return statusAlarm
+	}
+	since := now.Sub(e.lastCheckin)
+	if since > lim.alarm || (lim.warn > 0 && since > lim.warn) {
+		if e.ackedUntil.After(now) {
+			return statusAcked
+		}
+		if since > lim.alarm+lim.grace {
+			return statusAlarm
+		} else if since > lim.alarm {
+			return statusLate
+		}
+		return statusWarn
+	}
+	return statusOkay
+}
+
+type transition struct {
+	Key  string
+	From string
+	To   string
+	At   time.Time // when the new status took effect
+
+	AlarmSince time.Time // when the key went into ALARM, if it's recovering
+}
+
+// setState records the current status of key, computed from e, returning
+// the transition if the status has changed since it was last recorded.
+// Either way, tr.At is when the key entered the status, zero if unknown.
+// Statuses computed from data that has changed meanwhile, e.g. by a checkin
+// landing during evaluate, aren't recorded, since they'd report a bogus
+// ALARM right after the recovery; whoever changed the data observes it.
+func (s *Server) setState(key, status string, at time.Time, e entry) (transition, bool) {
+	// most of the time nothing changes, and reads shouldn't wait for each other
+	s.mu.RLock()
+	old, ok := s.states[key]
+	since := s.stateSince[key]
+	s.mu.RUnlock()
+	if ok && old == status {
+		return transition{Key: key, From: old, To: status, At: since}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok = s.states[key]
+	if !ok {
+		old = statusNever
+	}
+	if s.entryOf(key) != e {
+		return transition{Key: key, From: old, To: old, At: s.stateSince[key]}, false
+	}
+	tr := transition{Key: key, From: old, To: status, At: at}
+	if old == status {
+		tr.At = s.stateSince[key]
+		return tr, false
+	}
+	s.states[key] = status
+	s.stateSince[key] = at
+	s.markDirty(key)
+	// An acknowledged alarm is still the same alarm.
+	switch status {
+	case statusAlarm, statusAcked:
+		if _, ok := s.alarmSince[key]; !ok {
+			s.alarmSince[key] = at
+		}
+	default:
+		tr.AlarmSince = s.alarmSince[key]
+		delete(s.alarmSince, key)
+	}
+	return tr, true
+}
+
+// observe computes the status of key and records it, reacting to any
+// transition. Keys that have never checked in aren't recorded.
+func (s *Server) observe(key string, lim limits, e entry, now time.Time) *keyStatus {
+	st := statusOf(key, lim, e, now)
+	status := st.Status
+	if e.lastCheckin.IsZero() {
+		return st
+	}
+	if s.inStartupGrace(lim, e, status, now) {
+		s.mu.RLock()
+		st.Status = cmp.Or(s.states[key], statusOkay)
+		st.setStateSince(s.stateSince[key], now)
+		s.mu.RUnlock()
+		return st
+	}
+	at := now
+	switch {
+	case lim.inverse && status == statusOkay:
+		at = e.lastCheckin.Add(lim.alarm)
+	case lim.inverse:
+		at = e.lastCheckin
+	case !e.failedAt.IsZero():
+		at = e.failedAt
+	case status == statusAlarm:
+		at = e.lastCheckin.Add(lim.alarm + lim.grace)
+	case status == statusLate:
+		at = e.lastCheckin.Add(lim.alarm)
+	case status == statusAcked:
+		// acknowledged while still in WARN, before the deadline
+		if deadline := e.lastCheckin.Add(lim.alarm); deadline.Before(now) {
+			at = deadline
+		}
+	case status == statusWarn:
+		at = e.lastCheckin.Add(lim.warn)
+	}
+	tr, changed := s.setState(key, status, at, e)
+	if changed {
+		s.onTransition(tr, lim, e, st.since)
+		s.scheduleSave()
+	}
+	st.setStateSince(tr.At, now)
+	return st
+}
+
+// setStateSince fills in when the key entered its status, unless unknown.
+func (st *keyStatus) setStateSince(since, now time.Time) {
+	if since.IsZero() {
+		return
+	}
+	st.stateDuration = max(0, now.Sub(since))
+	secs := int64(st.stateDuration.Seconds())
+	st.StateSince, st.StateDurationSeconds = &since, &secs
+}
+
+// inStartupGrace reports whether key has become overdue only because the
+// server was down, and the startup grace period hasn't given it a chance
+// to check in yet. Such keys keep the status they had before the restart,
+// so a deploy doesn't cause a storm of false alarms.
+func (s *Server) inStartupGrace(lim limits, e entry, status string, now time.Time) bool {
+	if s.startupGrace <= 0 || !now.Before(s.startedAt.Add(s.startupGrace)) {
+		return false
+	}
+	if lim.inverse || !e.failedAt.IsZero() || !e.lastCheckin.Before(s.startedAt) {
+		return false
+	}
+	return status == statusAlarm || status == statusLate || status == statusWarn
+}
+
+func (s *Server) authMiddleware(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if st := s.settings(); st.jwtEnabled() {
+			s.jwtMiddleware(st, handler)(w, r)
+		} else {
+			tokenMiddleware(st.authTokens, handler)(w, r)
+		}
+	}
+}
+
+// readAuthMiddleware requires the read token (or any write token) when a read
+// token is configured, and lets everyone through otherwise.
+func (s *Server) readAuthMiddleware(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st := s.settings()
+		if st.readToken == "" {
+			handler(w, r)
+			return
+		}
+		token, ok := requestToken(r)
+		if !ok {
+			http.Error(w, "Invalid Authorization format", http.StatusBadRequest)
+			return
+		}
+		if matchToken([]string{st.readToken}, token) < 0 && !s.isWriteToken(token) {
+			unauthorized(w)
 			return
+		}
+		handler(w, r)
+	}
+}
+
+// metricsAuthMiddleware requires the metrics token when one is configured.
+func (s *Server) metricsAuthMiddleware(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := s.settings().metricsToken; token != "" {
+			tokenMiddleware([]string{token}, handler)(w, r)
 		} else {
-			log.Fatalf("error loading watchdogd database: %v", err)
+			handler(w, r)
 		}
 	}
+}
+
+// checkinAuthMiddleware requires the key's own token for keys that have one,
+// and a global token for all other keys.
+func (s *Server) checkinAuthMiddleware(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st := s.settings()
+		if token, ok := st.keyTokens[r.PathValue("key")]; ok {
+			tokenMiddleware([]string{token}, handler)(w, r)
+		} else {
+			s.authMiddleware(handler)(w, r)
+		}
+	}
+}
+
+// limitBody fails reading more than maxBodySize bytes of the request
+// body, so that huge requests aren't buffered, see bodyError.
+func (s *Server) limitBody(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxBodySize)
+		handler(w, r)
+	}
+}
+
+// bodyError responds to a failure to read or decode the request body.
+func bodyError(w http.ResponseWriter, err error, msg string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Request body too large, at most %d bytes allowed", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+	} else {
+		http.Error(w, msg, http.StatusBadRequest)
+	}
+}
+
+// tokenMiddleware only lets through requests bearing one of the given tokens.
+func tokenMiddleware(tokens []string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := requestToken(r)
+		if !ok {
+			http.Error(w, "Invalid Authorization format", http.StatusBadRequest)
+			return
+		}
+
+		idx := matchToken(tokens, token)
+		if idx < 0 {
+			unauthorized(w)
+			return
+		}
+		if len(tokens) > 1 {
+			logEvent(slog.LevelInfo, "auth", fmt.Sprintf("%s %s authenticated with token #%d", r.Method, r.URL.Path, idx+1),
+				"method", r.Method, "path", r.URL.Path, "token_index", idx+1)
+		}
+
+		handler(w, r)
+	}
+}
+
+// matchToken returns the index of token in tokens, or -1. All tokens are
+// compared in constant time, so the timing doesn't reveal which one matched.
+func matchToken(tokens []string, token string) int {
+	idx := -1
+	for i, expected := range tokens {
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1 {
+			idx = i
+		}
+	}
+	return idx
+}
+
+// requestToken extracts the token from the Authorization header or, failing
+// that, from the token query parameter. With Basic auth, the token is the
+// password, or the username if the password is empty.
+func requestToken(r *http.Request) (string, bool) {
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		return r.URL.Query().Get("token"), true
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		return cmp.Or(password, user), true
+	}
+	return strings.CutPrefix(token, "Bearer ")
+}
+
+// unauthorized rejects a request, asking browsers for the token as the
+// Basic auth password.
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="watchdogd", charset="UTF-8"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// Handler returns the HTTP API of the server.
+func (s *Server) Handler() http.Handler {
+	// GET patterns also serve HEAD, with the same status and headers
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /{key...}", keyRoutes{
+		"":              s.checkinAuthMiddleware(s.limitBody(s.checkinHandler(checkinSuccess))),
+		"/start":        s.checkinAuthMiddleware(s.limitBody(s.checkinHandler(checkinStart))),
+		"/fail":         s.checkinAuthMiddleware(s.limitBody(s.checkinHandler(checkinFail))),
+		"/alertmanager": s.checkinAuthMiddleware(s.limitBody(s.alertmanagerHandler)),
+		"/ack":          s.authMiddleware(s.ackHandler),
+		"/rename":       s.authMiddleware(s.renameHandler),
+		"/config":       s.authMiddleware(s.configHandler),
+	}.serve)
+	mux.HandleFunc("POST /batch", s.authMiddleware(s.limitBody(s.batchHandler)))
+	mux.HandleFunc("DELETE /{key...}", s.authMiddleware(s.deleteHandler))
+	mux.HandleFunc("GET /export", s.authMiddleware(gzipped(s.exportHandler)))
+	mux.HandleFunc("POST /import", s.authMiddleware(s.importHandler))
+	mux.HandleFunc("GET /{key...}", keyRoutes{
+		"":         s.corsMiddleware(s.readAuthMiddleware(gzipped(s.statusHandler))),
+		"/history": s.corsMiddleware(s.readAuthMiddleware(gzipped(s.historyHandler))),
+		"/sla":     s.corsMiddleware(s.readAuthMiddleware(s.slaHandler)),
+	}.serve)
+	mux.HandleFunc("GET /status", s.corsMiddleware(s.readAuthMiddleware(gzipped(s.multiStatusHandler))))
+	mux.HandleFunc("GET /version", s.corsMiddleware(s.readAuthMiddleware(versionHandler)))
+	mux.HandleFunc("GET /events", s.corsMiddleware(s.readAuthMiddleware(s.eventsHandler)))
+	mux.HandleFunc("GET /ws", s.readAuthMiddleware(s.wsHandler))
+	mux.HandleFunc("GET /metrics", s.corsMiddleware(s.metricsAuthMiddleware(gzipped(s.metricsHandler))))
+	mux.HandleFunc("GET /{$}", s.corsMiddleware(s.readAuthMiddleware(gzipped(s.listHandler))))
+	mux.HandleFunc("GET /dashboard", s.corsMiddleware(s.readAuthMiddleware(gzipped(s.dashboardHandler))))
+	for _, path := range []string{"/{key...}", "/status", "/version", "/events", "/metrics", "/{$}", "/dashboard"} {
+		mux.HandleFunc("OPTIONS "+path, s.preflightHandler)
+	}
+
+	// /ping/{key...} and /alertmanager/{key...} would conflict with the
+	// /{key...} routes, so the prefixed routes get a mux of their own.
+	prefixed := http.NewServeMux()
+	for _, method := range []string{"GET", "POST"} {
+		prefixed.HandleFunc(method+" /ping/{key...}", keyRoutes{
+			"":       s.checkinAuthMiddleware(s.limitBody(s.pingHandler(checkinSuccess))),
+			"/start": s.checkinAuthMiddleware(s.limitBody(s.pingHandler(checkinStart))),
+			"/fail":  s.checkinAuthMiddleware(s.limitBody(s.pingHandler(checkinFail))),
+		}.serve)
+	}
+	prefixed.HandleFunc("POST /alertmanager/{key...}", s.checkinAuthMiddleware(s.limitBody(s.alertmanagerHandler)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/ping/") || strings.HasPrefix(r.URL.Path, "/alertmanager/") {
+			prefixed.ServeHTTP(w, r)
+		} else {
+			mux.ServeHTTP(w, r)
+		}
+	})
+}
+
+// keyRoutes serves /{key...}, picking the handler by the last path segment,
+// like /start, since ServeMux patterns can't continue after a {key...}
+// wildcard. Keys may contain slashes, but never end with one of these
+// segments, see validName.
+type keyRoutes map[string]http.HandlerFunc
+
+func (routes keyRoutes) serve(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if i := strings.LastIndexByte(key, '/'); i >= 0 {
+		if handler, ok := routes[key[i:]]; ok {
+			r.SetPathValue("key", key[:i])
+			handler(w, r)
+			return
+		}
+	}
+	routes[""](w, r)
+}
+
+// Checkin records a checkin of the given kind of key from the given address,
+// returning the status the key had before. The note replaces the previous one.
+func (s *Server) Checkin(key, kind, source, note string) (*keyStatus, error) {
+	if s.readOnly {
+		return nil, errReadOnly
+	}
+	lim, ok := s.limits(key)
+	if !ok {
+		return nil, errInvalidKey
+	}
+	if lim.inverse && kind != checkinSuccess {
+		return nil, errInverseKind
+	}
+	if !s.settings().allowsInterval(lim.alarm) {
+		return nil, errIntervalBounds
+	}
+	if len(note) > maxNoteLen {
+		return nil, errNoteTooLong
+	}
+
+	now := now().UTC()
+	if !s.allowCheckin(key, now) {
+		return nil, errTooManyCheckins
+	}
+	s.mu.Lock()
+	if !s.canAdd(key) {
+		s.mu.Unlock()
+		return nil, errTooManyKeys
+	}
+	prev := statusOf(key, lim, s.entryOf(key), now)
+	s.record(key, now, kind, source, note)
+	e := s.entryOf(key)
+	s.mu.Unlock()
+
+	if jsonLogs {
+		logEvent(slog.LevelInfo, "checkin", "checkin", "key", key, "kind", kind)
+	}
+
+	// Recover right away rather than on the next evaluation, so that a key
+	// which recovers and alarms again between two evaluations reports both.
+	s.observe(key, lim, e, now)
+
+	s.scheduleSave()
+	return prev, nil
+}
+
+// checkinNote returns the note sent as ?note= or as the request body.
+func checkinNote(r *http.Request) (string, error) {
+	if note := r.URL.Query().Get("note"); note != "" {
+		return note, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxNoteLen+1))
+	return strings.TrimSpace(string(body)), err
+}
+
+// checkinHandler checks in with the given kind, unless ?state= asks for
+// another one.
+func (s *Server) checkinHandler(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		kind := kind
+		switch state := r.URL.Query().Get("state"); state {
+		case "":
+		case checkinSuccess, checkinStart, checkinFail:
+			kind = state
+		default:
+			http.Error(w, "Invalid state, must be success, start or fail", http.StatusBadRequest)
+			return
+		}
+		note, err := checkinNote(r)
+		if err != nil {
+			bodyError(w, err, "Error reading request body")
+			return
+		}
+		span := startSpan(r, "Checkin", r.PathValue("key"))
+		prev, err := s.Checkin(r.PathValue("key"), kind, s.clientAddr(r), note)
+		if err != nil {
+			endSpan(span, err)
+			httpError(w, err)
+			return
+		}
+		endSpan(span, nil, attribute.String("watchdog.kind", kind), attribute.String("watchdog.previous_status", prev.Status))
+		if wantsJSON(r) {
+			writeJSON(w, &checkinResponse{PreviousStatus: prev.Status, PreviousSinceSeconds: prev.SinceSeconds})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// alertmanagerPayload is the part of the Alertmanager webhook we look at.
+type alertmanagerPayload struct {
+	Status string `json:"status"` // firing or resolved
+}
+
+// alertmanagerHandler checks in when Alertmanager reports that the alerts
+// of a group have resolved, so that the key goes into ALARM when Alertmanager
+// stops reporting.
+func (s *Server) alertmanagerHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if _, ok := s.limits(key); !ok {
+		httpError(w, errInvalidKey)
+		return
+	}
+	var payload alertmanagerPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		bodyError(w, err, "Invalid JSON, expected an Alertmanager webhook payload")
+		return
+	}
+	if payload.Status == "resolved" {
+		if _, err := s.Checkin(key, checkinSuccess, s.clientAddr(r), ""); err != nil {
+			httpError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pingHandler checks in like Healthchecks.io pings do, answering OK, so that
+// existing integrations only need a new URL.
+func (s *Server) pingHandler(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		note, err := checkinNote(r)
+		if err != nil {
+			bodyError(w, err, "Error reading request body")
+			return
+		}
+		span := startSpan(r, "Checkin", r.PathValue("key"))
+		prev, err := s.Checkin(r.PathValue("key"), kind, s.clientAddr(r), note)
+		if err != nil {
+			endSpan(span, err)
+			httpError(w, err)
+			return
+		}
+		endSpan(span, nil, attribute.String("watchdog.kind", kind), attribute.String("watchdog.previous_status", prev.Status))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, "OK")
+	}
+}
+
+// checkinResponse tells a JSON client what state the key was in before
+// the checkin.
+type checkinResponse struct {
+	PreviousStatus       string `json:"previous_status"`
+	PreviousSinceSeconds *int64 `json:"previous_since_seconds,omitempty"`
+}
+
+// batchHandler checks in several keys at once. Invalid keys are reported
+// in the per-key results instead of failing the whole batch.
+func (s *Server) batchHandler(w http.ResponseWriter, r *http.Request) {
+	if s.readOnly {
+		httpError(w, errReadOnly)
+		return
+	}
+	var keys []string
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		bodyError(w, err, "Invalid JSON, expected an array of keys")
+		return
+	}
+
+	now := now().UTC()
+	results := make([]*batchResult, len(keys))
+	lims := make([]limits, len(keys))
+	for i, key := range keys {
+		results[i] = &batchResult{Key: key, OK: true}
+		var ok bool
+		if lims[i], ok = s.limits(key); !ok {
+			results[i].OK, results[i].Error = false, "Invalid key"
+		} else if !s.settings().allowsInterval(lims[i].alarm) {
+			results[i].OK, results[i].Error = false, "Interval out of range"
+		} else if _, ok := s.settings().keyTokens[key]; ok {
+			// such keys only accept their own token, see checkinAuthMiddleware
+			results[i].OK, results[i].Error = false, "Unauthorized"
+		} else if !s.allowCheckin(key, now) {
+			results[i].OK, results[i].Error = false, "Too many checkins"
+		}
+	}
+
+	source := s.clientAddr(r)
+	es := make([]entry, len(keys))
+	s.mu.Lock()
+	for i, key := range keys {
+		if results[i].OK && !s.canAdd(key) {
+			results[i].OK, results[i].Error = false, "Too many keys"
+		}
+		if results[i].OK {
+			s.record(key, now, checkinSuccess, source, "")
+			es[i] = s.entryOf(key)
+		}
+	}
+	s.mu.Unlock()
+
+	for i, key := range keys {
+		if results[i].OK {
+			if jsonLogs {
+				logEvent(slog.LevelInfo, "checkin", "checkin", "key", key, "status", statusOkay)
+			}
+			s.observe(key, lims[i], es[i], now)
+		}
+	}
+
+	s.scheduleSave()
+	writeJSON(w, results)
+}
+
+type batchResult struct {
+	Key   string `json:"key"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// allowsInterval reports whether alarm is within -min-interval and
+// -max-interval.
+func (st *settings) allowsInterval(alarm time.Duration) bool {
+	return alarm >= st.minInterval && (st.maxInterval <= 0 || alarm <= st.maxInterval)
+}
+
+// canAdd reports whether key may be checked in without going over maxKeys.
+// Must be called with mu held.
+func (s *Server) canAdd(key string) bool {
+	maxKeys := s.settings().maxKeys
+	if maxKeys <= 0 {
+		return true
+	}
+	_, found := s.checkins[key]
+	return found || len(s.checkins) < maxKeys
+}
+
+// record stores a checkin. Must be called with mu held.
+func (s *Server) record(key string, t time.Time, kind, source, note string) {
+	s.checkins[key] = t
+	switch kind {
+	case checkinStart:
+		s.starts[key] = t
+	case checkinFail:
+		delete(s.starts, key)
+		s.failures[key] = t
+	default:
+		delete(s.starts, key)
+		delete(s.failures, key)
+		s.addHistory(key, t) // only successful runs
+	}
+	s.sources[key] = source
+	if note != "" {
+		s.notes[key] = note
+	} else {
+		delete(s.notes, key)
+	}
+	s.markDirty(key)
+}
+
+// clientAddr returns the IP address of the client. Behind a trusted proxy,
+// that's the last address the proxy added to X-Forwarded-For; the earlier
+// ones come from the client and can't be trusted.
+func (s *Server) clientAddr(r *http.Request) string {
+	if s.trustProxy {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			addrs := strings.Split(fwd[len(fwd)-1], ",")
+			if addr := strings.TrimSpace(addrs[len(addrs)-1]); addr != "" {
+				return addr
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr // e.g. a unix socket
+	}
+	return host
+}
 
-	err = json.Unmarshal(data, &checkins)
-	if err != nil {
-		log.Printf("corrupted watchdogd database file, starting with an empty database.")
+// addHistory remembers a checkin, keeping at most historySize most recent
+// ones. Must be called with mu held.
+func (s *Server) addHistory(key string, t time.Time) {
+	if s.historySize <= 0 {
+		return
 	}
+	h := s.history[key]
+	if len(h) >= s.historySize {
+		// shift in place rather than reallocate every historySize checkins;
+		// everyone else gets copies, see snapshot
+		h = h[:copy(h, h[len(h)-s.historySize+1:])]
+	}
+	s.history[key] = append(h, t)
 }
 
-func save() {
-	if filename == "" {
+func (s *Server) historyHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if _, ok := s.limits(key); !ok {
+		http.Error(w, "Invalid key", http.StatusBadRequest)
 		return
 	}
-	mu.Lock()
-	m := maps.Clone(checkins)
-	mu.Unlock()
 
-	data := must(json.MarshalIndent(m, "", "  "))
-	err := os.WriteFile(filename, data, 0644)
-	if err != nil {
-		log.Fatalf("watchdogd saving failed: %v", err)
+	s.mu.RLock()
+	h := slices.Clone(s.history[key])
+	s.mu.RUnlock()
+
+	if h == nil {
+		h = []time.Time{}
 	}
+	writeJSON(w, h)
 }
 
-func parse(key string) (time.Duration, bool) {
-	m := keyRe.FindStringSubmatchIndex(key)
-	if m == nil {
-		return 0, false
+func (s *Server) ackHandler(w http.ResponseWriter, r *http.Request) {
+	dur, _ := time.ParseDuration(r.URL.Query().Get("duration")) // 0 if invalid
+	if err := s.Ack(r.PathValue("key"), dur); err != nil {
+		httpError(w, err)
+		return
 	}
-	return must(time.ParseDuration(key[m[2]:m[3]])), true
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func authMiddleware(handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("Authorization")
-		if token == "" {
-			token = r.URL.Query().Get("token")
-		} else {
-			var ok bool
-			token, ok = strings.CutPrefix(token, "Bearer ")
-			if !ok {
-				http.Error(w, "Invalid Authorization format", http.StatusBadRequest)
-				return
-			}
-		}
+// Ack silences the alarms of key for the given duration.
+func (s *Server) Ack(key string, dur time.Duration) error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	if _, ok := s.limits(key); !ok {
+		return errInvalidKey
+	}
+	if dur <= 0 {
+		return errInvalidDuration
+	}
 
-		if subtle.ConstantTimeCompare([]byte(authToken), []byte(token)) != 1 {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+	until := now().UTC().Add(dur)
+	s.mu.Lock()
+	_, found := s.checkins[key]
+	if found {
+		s.acks[key] = until
+		s.markDirty(key)
+	}
+	s.mu.Unlock()
 
-		handler(w, r)
+	if !found {
+		return errKeyNotFound
 	}
+	s.scheduleSave()
+	return nil
 }
 
-func checkinHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	if s.readOnly {
+		httpError(w, errReadOnly)
+		return
+	}
 	key := r.PathValue("key")
-	if _, ok := parse(key); !ok {
+	if _, ok := s.limits(key); !ok {
 		http.Error(w, "Invalid key", http.StatusBadRequest)
 		return
 	}
 
-	now := time.Now().UTC()
-	mu.Lock()
-	checkins[key] = now
-	mu.Unlock()
+	s.mu.Lock()
+	_, found := s.checkins[key]
+	if _, ok := s.intervals[key]; ok {
+		found = true
+	}
+	if found {
+		s.deleteKey(key)
+	}
+	s.mu.Unlock()
 
-	go save()
+	if !found {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	s.scheduleSave()
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func statusHandler(w http.ResponseWriter, r *http.Request) {
-	key := r.PathValue("key")
-	dur, ok := parse(key)
+func (s *Server) renameHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.Rename(r.PathValue("key"), r.URL.Query().Get("to")); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Rename moves the checkins, state, history and notes of a key to a new key,
+// e.g. one with another threshold. The new key must not exist yet.
+func (s *Server) Rename(from, to string) error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	if _, ok := s.limits(from); !ok {
+		return errInvalidKey
+	}
+	// a key with configured limits takes them along, so it needs none in its name
+	_, configured := s.interval(from)
+	if _, ok := parse(to); !ok && !(configured && validName(to)) {
+		return errInvalidKey
+	}
+
+	s.mu.Lock()
+	if _, found := s.checkins[from]; !found {
+		s.mu.Unlock()
+		return errKeyNotFound
+	}
+	if _, found := s.checkins[to]; found || from == to {
+		s.mu.Unlock()
+		return errKeyExists
+	}
+	moveKey(s.checkins, from, to)
+	moveKey(s.states, from, to)
+	moveKey(s.alarmSince, from, to)
+	moveKey(s.stateSince, from, to)
+	moveKey(s.acks, from, to)
+	moveKey(s.history, from, to)
+	moveKey(s.sources, from, to)
+	moveKey(s.notes, from, to)
+	moveKey(s.starts, from, to)
+	moveKey(s.failures, from, to)
+	moveKey(s.reminders, from, to)
+	s.metaMu.Lock()
+	moveKey(s.intervals, from, to)
+	s.metaMu.Unlock()
+	delete(s.held, from) // the event names the old key
+	s.markDirty(from)
+	s.markDirty(to)
+	s.mu.Unlock()
+
+	logEvent(slog.LevelInfo, "rename", fmt.Sprintf("renamed %s to %s", from, to), "key", from, "to", to)
+	s.scheduleSave()
+	return nil
+}
+
+func moveKey[V any](m map[string]V, from, to string) {
+	if v, ok := m[from]; ok {
+		m[to] = v
+		delete(m, from)
+	}
+}
+
+// deleteKey forgets everything about key. Must be called with mu held.
+func (s *Server) deleteKey(key string) {
+	delete(s.checkins, key)
+	delete(s.states, key)
+	delete(s.alarmSince, key)
+	delete(s.stateSince, key)
+	delete(s.acks, key)
+	delete(s.history, key)
+	delete(s.sources, key)
+	delete(s.notes, key)
+	delete(s.starts, key)
+	delete(s.failures, key)
+	s.metaMu.Lock()
+	delete(s.intervals, key)
+	s.metaMu.Unlock()
+	s.markDirty(key)
+}
+
+// Status returns the current status of key.
+func (s *Server) Status(key string) (*keyStatus, error) {
+	lim, ok := s.limits(key)
 	if !ok {
-		http.Error(w, "Invalid key", http.StatusBadRequest)
+		return nil, errInvalidKey
+	}
+
+	s.mu.RLock()
+	e := s.entryOf(key)
+	s.mu.RUnlock()
+
+	return s.observe(key, lim, e, now()), nil
+}
+
+func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	span := startSpan(r, "Status", r.PathValue("key"))
+	st, err := s.Status(r.PathValue("key"))
+	if err != nil {
+		endSpan(span, err)
+		httpError(w, err)
 		return
 	}
+	endSpan(span, nil, attribute.String("watchdog.status", st.Status))
+	code := http.StatusOK
+	// ?code=1 is for uptime checkers that only look at the status code
+	if r.URL.Query().Get("code") == "1" && unhealthy(st.Status) {
+		// a checkin now would clear the alarm after this long
+		retry := st.ThresholdSeconds
+		if st.Inverse && st.RemainingSeconds != nil {
+			retry = *st.RemainingSeconds
+		}
+		w.Header().Set("Retry-After", strconv.FormatInt(max(retry, 1), 10))
+		code = http.StatusServiceUnavailable
+	}
+	s.writeStatus(w, r, st, code)
+}
 
-	mu.Lock()
-	lastCheckin := checkins[key]
-	mu.Unlock()
+// unhealthy reports whether ?code=1 answers 503 for a key with status:
+// when it's overdue, even if still within its grace period, or has never
+// checked in.
+func unhealthy(status string) bool {
+	return status == statusAlarm || status == statusLate || status == statusNever
+}
 
-	now := time.Now()
+func (s *Server) writeStatus(w http.ResponseWriter, r *http.Request, st *keyStatus, code int) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write(must(json.Marshal(st)))
+		return
+	}
 	w.Header().Set("Content-Type", "text/plain")
-	printStatus(w, key, dur, lastCheckin, now)
+	w.WriteHeader(code)
+	s.printStatus(w, st, wantsColor(r))
+}
+
+// multiStatusHandler returns the status of the keys listed in ?keys=,
+// in the order given.
+func (s *Server) multiStatusHandler(w http.ResponseWriter, r *http.Request) {
+	keys := splitList(r.URL.Query().Get("keys"))
+	lims := make([]limits, len(keys))
+	for i, key := range keys {
+		var ok bool
+		if lims[i], ok = s.limits(key); !ok {
+			http.Error(w, "Invalid key "+key, http.StatusBadRequest)
+			return
+		}
+	}
+
+	es := make([]entry, len(keys))
+	s.mu.RLock()
+	for i, key := range keys {
+		es[i] = s.entryOf(key)
+	}
+	s.mu.RUnlock()
+
+	now := now()
+	resp := &listResponse{Count: len(keys), Keys: make([]*keyStatus, 0, len(keys))}
+	for i, key := range keys {
+		resp.Keys = append(resp.Keys, s.observe(key, lims[i], es[i], now))
+	}
+	writeJSON(w, resp)
+}
+
+type listResponse struct {
+	Count  int          `json:"count"` // of all matching keys, also with ?limit=
+	Offset int          `json:"offset,omitempty"`
+	Limit  int          `json:"limit,omitempty"`
+	Keys   []*keyStatus `json:"keys"`
+	Groups []*keyGroup  `json:"groups,omitempty"` // with ?group=prefix
+}
+
+// paginate cuts resp.Keys down to limit keys starting at offset, or to all
+// keys after offset if limit is 0.
+func (resp *listResponse) paginate(offset, limit int) {
+	resp.Offset, resp.Limit = offset, limit
+	resp.Keys = resp.Keys[min(offset, len(resp.Keys)):]
+	if limit > 0 {
+		resp.Keys = resp.Keys[:min(limit, len(resp.Keys))]
+	}
+}
+
+// statusSeverity orders the statuses for ?sort=status, worst first.
+var statusSeverity = []string{statusAlarm, statusNever, statusLate, statusWarn, statusAcked, statusOkay}
+
+// listOrders are the orders of ?sort=, all falling back to the key name.
+var listOrders = map[string]func(a, b *keyStatus) int{
+	"key": func(a, b *keyStatus) int { return strings.Compare(a.Key, b.Key) },
+	// most overdue first, keys that never checked in before all others
+	"since": func(a, b *keyStatus) int {
+		if a.lastCheckin.IsZero() != b.lastCheckin.IsZero() {
+			if a.lastCheckin.IsZero() {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Or(cmp.Compare(a.remaining, b.remaining), strings.Compare(a.Key, b.Key))
+	},
+	"status": func(a, b *keyStatus) int {
+		return cmp.Or(
+			cmp.Compare(slices.Index(statusSeverity, a.Status), slices.Index(statusSeverity, b.Status)),
+			strings.Compare(a.Key, b.Key))
+	},
+}
+
+// keyGroup counts the statuses of the keys sharing a prefix.
+type keyGroup struct {
+	Prefix   string         `json:"prefix"`
+	Count    int            `json:"count"`
+	Statuses map[string]int `json:"statuses"`
+	keys     []*keyStatus
+}
+
+// groupByPrefix groups keys by their first segment, up to the first - or /,
+// like team-a in team-a/db/backup-1d. Inverse keys go with the others.
+func groupByPrefix(keys []*keyStatus) []*keyGroup {
+	groups := make(map[string]*keyGroup)
+	for _, st := range keys {
+		prefix := strings.TrimPrefix(st.Key, "~")
+		if i := strings.IndexAny(prefix, "-/"); i > 0 {
+			prefix = prefix[:i]
+		}
+		g := groups[prefix]
+		if g == nil {
+			g = &keyGroup{Prefix: prefix, Statuses: make(map[string]int)}
+			groups[prefix] = g
+		}
+		g.Count++
+		g.Statuses[st.Status]++
+		g.keys = append(g.keys, st)
+	}
+	return slices.SortedFunc(maps.Values(groups), func(a, b *keyGroup) int {
+		return strings.Compare(a.Prefix, b.Prefix)
+	})
 }
 
-func listHandler(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-	m := maps.Clone(checkins)
-	mu.Unlock()
+// List returns the status of all keys.
+func (s *Server) List() *listResponse {
+	s.mu.RLock()
+	m := s.entries()
+	s.mu.RUnlock()
+
+	now := now()
+	resp := &listResponse{Count: len(m), Keys: make([]*keyStatus, 0, len(m))}
+	for key, e := range m {
+		lim, _ := s.limits(key)
+		resp.Keys = append(resp.Keys, s.observe(key, lim, e, now))
+	}
+	return resp
+}
 
+func (s *Server) listHandler(w http.ResponseWriter, r *http.Request) {
+	resp := s.List()
+	if status := strings.ToUpper(r.URL.Query().Get("status")); status != "" {
+		switch status {
+		case statusOkay, statusWarn, statusLate, statusAlarm, statusAcked, statusNever:
+		default:
+			http.Error(w, "Invalid status", http.StatusBadRequest)
+			return
+		}
+		resp.Keys = slices.DeleteFunc(resp.Keys, func(st *keyStatus) bool {
+			return st.Status != status
+		})
+		resp.Count = len(resp.Keys)
+	}
+	order, ok := listOrders[cmp.Or(r.URL.Query().Get("sort"), "key")]
+	if !ok {
+		http.Error(w, "Invalid sort, must be key, since or status", http.StatusBadRequest)
+		return
+	}
+	slices.SortFunc(resp.Keys, order) // List doesn't hold mu while we're sorting
+	offset, err := strconv.Atoi(cmp.Or(r.URL.Query().Get("offset"), "0"))
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid offset, must be a non-negative number", http.StatusBadRequest)
+		return
+	}
+	limit, err := strconv.Atoi(cmp.Or(r.URL.Query().Get("limit"), "0"))
+	if err != nil || limit < 0 {
+		http.Error(w, "Invalid limit, must be a positive number", http.StatusBadRequest)
+		return
+	}
+	resp.paginate(offset, limit)
+	switch group := r.URL.Query().Get("group"); group {
+	case "":
+	case "prefix":
+		resp.Groups = groupByPrefix(resp.Keys)
+	default:
+		http.Error(w, "Invalid group, must be prefix", http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "csv" && format != "table" {
+		http.Error(w, "Invalid format, must be csv or table", http.StatusBadRequest)
+		return
+	}
+	if wantsCSV(r) {
+		writeCSV(w, resp.Keys)
+		return
+	}
+	if wantsJSON(r) {
+		writeJSON(w, resp)
+		return
+	}
+	if wantsHTML(r) {
+		s.renderDashboard(w, resp)
+		return
+	}
 	w.Header().Set("Content-Type", "text/plain")
-	fmt.Fprintf(w, "watchdogd has %d keys\n", len(m))
-	now := time.Now()
-	for key, lastCheckin := range m {
-		dur, _ := parse(key)
-		printStatus(w, key, dur, lastCheckin, now)
+	color := wantsColor(r)
+	print := func(keys []*keyStatus) {
+		for _, st := range keys {
+			s.printStatus(w, st, color)
+		}
+	}
+	if format == "table" {
+		print = func(keys []*keyStatus) { s.printTable(w, keys, color) }
+	}
+	fmt.Fprintf(w, "watchdogd has %d keys\n", resp.Count)
+	if len(resp.Keys) < resp.Count {
+		fmt.Fprintf(w, "showing %d from #%d\n", len(resp.Keys), resp.Offset+1)
+	}
+	if resp.Groups == nil {
+		print(resp.Keys)
+		return
+	}
+	for _, g := range resp.Groups {
+		fmt.Fprintf(w, "\n%s: %d keys", g.Prefix, g.Count)
+		for _, status := range []string{statusOkay, statusWarn, statusLate, statusAlarm, statusAcked, statusNever} {
+			if n := g.Statuses[status]; n > 0 {
+				fmt.Fprintf(w, ", %d %s", n, status)
+			}
+		}
+		fmt.Fprintln(w)
+		print(g.keys)
+	}
+}
+
+// printTable prints the main fields of the statuses in aligned columns.
+func (s *Server) printTable(w io.Writer, keys []*keyStatus, color bool) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tLAST CHECKIN\tSINCE\tSTATUS\tREMAINING")
+	for _, st := range keys {
+		last, since, remaining := "-", "-", "-"
+		if !st.lastCheckin.IsZero() {
+			last = st.lastCheckin.In(s.location).Format(time.RFC3339)
+			since = s.formatSince(st.since)
+			remaining = st.remaining.Round(time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", st.Key, last, since, colored(st.Status, color), remaining)
+	}
+	tw.Flush()
+}
+
+// formatSince formats the time since the last checkin as per -since-format.
+func (s *Server) formatSince(d time.Duration) string {
+	if s.sinceFormat == sinceRelative {
+		return formatRelative(d)
+	}
+	return formatUnits(d)
+}
+
+// wantsColor reports whether the text output should be colorized for
+// a terminal, which the server can't detect, so it's asked for with ?color=1.
+func wantsColor(r *http.Request) bool {
+	color, _ := strconv.ParseBool(r.URL.Query().Get("color"))
+	return color
+}
+
+// statusColors are all of the same length, so that colored columns still
+// line up in printTable.
+var statusColors = map[string]string{
+	statusOkay:  "\x1b[32m", // green
+	statusWarn:  "\x1b[33m", // yellow
+	statusLate:  "\x1b[33m",
+	statusAlarm: "\x1b[31m", // red
+	statusAcked: "\x1b[39m", // default
+	statusNever: "\x1b[39m",
+}
+
+// colored wraps status in the ANSI codes of its color, if enabled.
+func colored(status string, color bool) string {
+	if code, ok := statusColors[status]; ok && color {
+		return code + status + "\x1b[0m"
 	}
+	return status
 }
 
-func printStatus(w io.Writer, key string, dur time.Duration, lastCheckin, now time.Time) {
-	if lastCheckin.IsZero() {
-		fmt.Fprintf(w, "%s NEVER ALARM\n", key)
+func (s *Server) printStatus(w io.Writer, st *keyStatus, color bool) {
+	if st.lastCheckin.IsZero() {
+		if st.Inverse {
+			fmt.Fprintf(w, "%s NEVER %s inverse\n", st.Key, colored(statusOkay, color))
+		} else {
+			fmt.Fprintf(w, "%s NEVER %s\n", st.Key, colored(statusAlarm, color))
+		}
 		return
 	}
-	since := now.Sub(lastCheckin)
-	var status string
-	if since > dur {
-		status = "ALARM"
-	} else {
-		status = "OKAY"
+	since := s.formatSince(st.since)
+	fmt.Fprintf(w, "%s %s %s %s remaining %s", st.Key, st.lastCheckin.In(s.location).Format(time.RFC3339), since, colored(st.Status, color), st.remaining.Round(time.Second))
+	if st.AlarmAt != nil {
+		fmt.Fprintf(w, " alarm at %s", st.AlarmAt.In(s.location).Format(time.RFC3339))
+	}
+	if st.MissedIntervals > 0 {
+		fmt.Fprintf(w, " missed %d", st.MissedIntervals)
+	}
+	if st.StateSince != nil {
+		fmt.Fprintf(w, " %s for %s", st.Status, formatUnits(st.stateDuration))
+	}
+	if st.ackRemaining > 0 {
+		fmt.Fprintf(w, " acked for %s", st.ackRemaining.Round(time.Second))
+	}
+	if st.Inverse {
+		fmt.Fprint(w, " inverse")
+	}
+	if st.State != "" {
+		fmt.Fprintf(w, " %s", st.State)
+	}
+	if st.Source != "" {
+		fmt.Fprintf(w, " from %s", st.Source)
+	}
+	if st.Note != "" {
+		fmt.Fprintf(w, " note %q", st.Note)
+	}
+	fmt.Fprintln(w)
+}
+
+// httpError responds with the HTTP equivalent of an error returned by the
+// Server methods.
+func httpError(w http.ResponseWriter, err error) {
+	switch err {
+	case errInvalidKey:
+		http.Error(w, "Invalid key", http.StatusBadRequest)
+	case errTooManyKeys:
+		http.Error(w, "Too many keys", http.StatusTooManyRequests)
+	case errIntervalBounds:
+		http.Error(w, "Interval out of bounds, see -min-interval and -max-interval", http.StatusBadRequest)
+	case errTooManyCheckins:
+		http.Error(w, "Too many checkins", http.StatusTooManyRequests)
+	case errNoteTooLong:
+		http.Error(w, fmt.Sprintf("Note too long, at most %d bytes allowed", maxNoteLen), http.StatusRequestEntityTooLarge)
+	case errInverseKind:
+		http.Error(w, "Inverse keys only take plain checkins", http.StatusBadRequest)
+	case errInvalidDuration:
+		http.Error(w, "Invalid duration", http.StatusBadRequest)
+	case errKeyNotFound:
+		http.Error(w, "Key not found", http.StatusNotFound)
+	case errKeyExists:
+		http.Error(w, "Key already exists", http.StatusConflict)
+	case errReadOnly:
+		http.Error(w, "Read-only instance", http.StatusForbidden)
+	default:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// formatUnits formats d as days, hours, minutes and seconds, like 2h 5m 3s.
+func formatUnits(d time.Duration) string {
+	secs := int64(d.Seconds())
+	days, hours, mins := secs/86400, secs/3600%24, secs/60%60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh %dm %ds", days, hours, mins, secs%60)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm %ds", hours, mins, secs%60)
+	case mins > 0:
+		return fmt.Sprintf("%dm %ds", mins, secs%60)
+	default:
+		return fmt.Sprintf("%ds", secs)
+	}
+}
+
+// formatRelative formats d as an approximate age, like 2 hours ago.
+func formatRelative(d time.Duration) string {
+	plural := func(n int64, unit string) string {
+		if n == 1 {
+			return "1 " + unit + " ago"
+		}
+		return fmt.Sprintf("%d %ss ago", n, unit)
+	}
+	switch secs := int64(d.Seconds()); {
+	case secs < 1:
+		return "just now"
+	case secs < 60:
+		return plural(secs, "second")
+	case secs < 3600:
+		return plural(secs/60, "minute")
+	case secs < 86400:
+		return plural(secs/3600, "hour")
+	default:
+		return plural(secs/86400, "day")
+	}
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// jsonBuffers are reused by writeJSON, so that large responses like the
+// list don't allocate their whole size every time.
+var jsonBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// maxPooledJSON keeps the buffers of unusually large responses from being
+// held onto.
+const maxPooledJSON = 1 << 20
+
+func writeJSON(w http.ResponseWriter, v any) {
+	buf := jsonBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	ensure(json.NewEncoder(buf).Encode(v))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))) // like json.Marshal
+	if buf.Cap() <= maxPooledJSON {
+		jsonBuffers.Put(buf)
+	}
+}
+
+func wantsCSV(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv")
+}
+
+// writeCSV writes one row per key, for spreadsheets. Keys that never checked
+// in have empty last_checkin and since_seconds.
+func writeCSV(w http.ResponseWriter, keys []*keyStatus) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"key", "last_checkin", "since_seconds", "status", "threshold_seconds"})
+	for _, st := range keys {
+		var last, since string
+		if st.LastCheckin != nil {
+			last = st.LastCheckin.UTC().Format(time.RFC3339)
+		}
+		if st.SinceSeconds != nil {
+			since = strconv.FormatInt(*st.SinceSeconds, 10)
+		}
+		cw.Write([]string{st.Key, last, since, st.Status, strconv.FormatInt(st.ThresholdSeconds, 10)})
+	}
+	cw.Flush()
+}
+
+// evaluator periodically checks all keys, so that alarms are noticed even
+// when nobody is polling the status endpoints.
+func (s *Server) evaluator() {
+	ticker := time.NewTicker(s.checkInterval)
+	defer ticker.Stop()
+	_, shared := s.store.(sharedStore)
+	for range ticker.C {
+		if shared {
+			s.refresh()
+		}
+		s.evaluate()
+		s.evaluated.Store(time.Now().UnixNano())
+	}
+}
+
+func (s *Server) evaluate() {
+	now := now()
+	s.mu.Lock()
+	for key, until := range s.acks {
+		if !until.After(now) {
+			delete(s.acks, key)
+			s.markDirty(key)
+		}
+	}
+	collected := s.collectGarbage(now)
+	m := s.entries()
+	s.mu.Unlock()
+
+	for _, key := range collected {
+		logEvent(slog.LevelInfo, "gc", fmt.Sprintf("forgetting %s, no checkins for over %v", key, s.settings().gcAfter), "key", key)
+	}
+	if len(collected) > 0 {
+		s.scheduleSave()
+	}
+
+	for key, e := range m {
+		lim, ok := s.limits(key)
+		if !ok {
+			continue
+		}
+		s.observe(key, lim, e, now)
+	}
+	s.endMaintenance(now)
+	s.remind(now)
+}
+
+// collectGarbage deletes keys that haven't checked in within gcAfter, and
+// returns their names. Keys that never checked in are given gcAfter since
+// the server start, and keys configured with /{key}/config are kept. Must be
+// called with mu held.
+func (s *Server) collectGarbage(now time.Time) []string {
+	gcAfter := s.settings().gcAfter
+	if gcAfter <= 0 {
+		return nil
+	}
+	var collected []string
+	stale := func(key string) {
+		if _, configured := s.interval(key); configured {
+			return
+		}
+		last := s.checkins[key]
+		if last.IsZero() {
+			last = s.startedAt
+		}
+		if now.Sub(last) > gcAfter {
+			s.deleteKey(key)
+			collected = append(collected, key)
+		}
+	}
+	for key := range s.checkins {
+		stale(key)
+	}
+	for key := range s.states {
+		stale(key)
+	}
+	for key := range s.acks {
+		stale(key)
 	}
-	fmt.Fprintf(w, "%s %s %.0fh %.0fm %.0fs %s\n", key, lastCheckin.Format(time.RFC3339), since.Hours(), since.Minutes(), since.Seconds(), status)
+
+	// the state that only lives in memory
+	s.bucketsMu.Lock()
+	for _, key := range collected {
+		delete(s.reminders, key)
+		delete(s.held, key)
+		delete(s.buckets, key)
+	}
+	s.bucketsMu.Unlock()
+	return collected
 }
 
 func main() {
 	log.SetFlags(0)
 	log.SetOutput(os.Stderr)
 
-	var listenAddr string
-	flag.StringVar(&filename, "f", "", "path to JSON database file")
-	flag.StringVar(&authToken, "t", "", "bearer token for authorization")
-	flag.StringVar(&listenAddr, "l", ":8080", "listen address")
-	flag.Parse()
+	srv := newServer()
+	opts, err := configure(flag.CommandLine, os.Args[1:], srv, srv.settings())
+	if err != nil {
+		log.Fatalf("watchdogd: %v", err)
+	}
+	if opts.showVersion {
+		fmt.Println(buildVersion())
+		return
+	}
+	if err := setupLogging(opts.logFormat); err != nil {
+		log.Fatalf("watchdogd: %v", err)
+	}
 
-	if authToken == "" {
+	if st := srv.settings(); len(st.authTokens) == 0 && !st.jwtEnabled() {
 		var token [32]byte
 		must(rand.Read(token[:]))
-		authToken = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(token[:])
-		log.Printf("auth token not specified, using a random token: %s", authToken)
+		st.authTokens = []string{base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(token[:])}
+		if jsonLogs {
+			// Tokens never go into structured logs, which are usually shipped elsewhere.
+			logEvent(slog.LevelWarn, "startup", "auth token not specified, using a random token; pass -t to set one")
+		} else {
+			log.Printf("auth token not specified, using a random token: %s", st.authTokens[0])
+		}
 	}
 
-	if filename == "" {
+	if opts.dbSpec != "" {
+		var err error
+		srv.store, err = openStore(opts.dbSpec)
+		if err != nil {
+			log.Fatalf("watchdogd: %v", err)
+		}
+		if pg, ok := srv.store.(*postgresStore); ok {
+			pg.retention = opts.eventRetention
+		}
+	} else if opts.filename != "" {
+		srv.store = &jsonFileStore{filename: opts.filename, fsync: opts.fsync}
+	}
+	if opts.s3Backup != "" {
+		srv.s3, err = newS3Backup(opts.s3Backup)
+		if err != nil {
+			log.Fatalf("watchdogd: %v", err)
+		}
+	}
+	if opts.statsd != "" {
+		srv.statsd, err = newStatsd(opts.statsd)
+		if err != nil {
+			log.Fatalf("watchdogd: %v", err)
+		}
+	}
+	if srv.store == nil {
 		log.Printf("no filename specified, running an in-memory server.")
-	} else {
-		load()
+	}
+	if srv.store != nil || srv.s3 != nil {
+		srv.load()
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("POST /{key}", authMiddleware(checkinHandler))
-	mux.HandleFunc("GET /{key}", statusHandler)
-	mux.HandleFunc("/{$}", listHandler)
+	if srv.readOnly {
+		logEvent(slog.LevelWarn, "startup", "READ-ONLY MODE: refusing checkins, acks and deletes, and never saving the database", "read_only", true)
+	}
+	handler := srv.Handler()
+	if opts.accessLog {
+		handler = srv.accessLog(handler)
+	}
+	shutdownTracing := func(context.Context) error { return nil }
+	if opts.otelEndpoint != "" {
+		shutdownTracing, err = setupTracing(opts.otelEndpoint)
+		if err != nil {
+			log.Fatalf("watchdogd: %v", err)
+		}
+		handler = traced(handler)
+	}
+
+	srv.Start()
+	go srv.sdWatchdog()
 
-	log.Printf("running watchdogd on %s", listenAddr)
-	if err := http.ListenAndServe(listenAddr, mux); err != nil {
+	httpServer := &http.Server{
+		Addr:              opts.listenAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: opts.readTimeout,
+		ReadTimeout:       opts.readTimeout,
+		WriteTimeout:      opts.writeTimeout,
+		IdleTimeout:       opts.idleTimeout,
+	}
+	httpServer.RegisterOnShutdown(srv.events.close)
+
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			srv.reload(os.Args[1:])
+		}
+	}()
+
+	stopped := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		defer close(stopped)
+		sig := <-sigs
+		logEvent(slog.LevelInfo, "shutdown", fmt.Sprintf("received %v, shutting down.", sig), "signal", sig.String())
+		sdNotify("STOPPING=1")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			logEvent(slog.LevelError, "shutdown_failed", fmt.Sprintf("watchdogd shutdown: %v", err), "error", err)
+		}
+		if err := shutdownTracing(ctx); err != nil {
+			logEvent(slog.LevelError, "shutdown_failed", fmt.Sprintf("flushing traces: %v", err), "error", err)
+		}
+	}()
+
+	ln, err := listen(opts.listenAddr)
+	if err != nil {
+		log.Fatalf("watchdogd: %v", err)
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		logEvent(slog.LevelError, "sd_notify_failed", fmt.Sprintf("sd_notify: %v", err), "error", err)
+	}
+	if opts.tlsCert != "" || opts.tlsKey != "" {
+		if opts.tlsCert == "" || opts.tlsKey == "" {
+			log.Fatalf("watchdogd: both -tls-cert and -tls-key are required for HTTPS")
+		}
+		var certs *certReloader
+		certs, err = newCertReloader(opts.tlsCert, opts.tlsKey)
+		if err != nil {
+			log.Fatalf("watchdogd: loading TLS certificate: %v", err)
+		}
+		httpServer.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+		logEvent(slog.LevelInfo, "startup", fmt.Sprintf("running watchdogd on %s (HTTPS)", opts.listenAddr), "addr", opts.listenAddr, "tls", true)
+		err = httpServer.ServeTLS(ln, "", "")
+	} else {
+		logEvent(slog.LevelInfo, "startup", fmt.Sprintf("running watchdogd on %s (HTTP)", opts.listenAddr), "addr", opts.listenAddr, "tls", false)
+		err = httpServer.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
 		log.Fatal("watchdogd failed:", err)
 	}
+	<-stopped
+	srv.save()
+	if srv.s3 != nil {
+		srv.backup()
+	}
+	logEvent(slog.LevelInfo, "stopped", "watchdogd stopped.")
+}
+
+// listen listens on a TCP address, or on a unix socket given as unix:PATH.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	// a socket left behind by a crash would make Listen fail
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Closing the listener on shutdown removes the socket file.
+	if err := os.Chmod(path, socketMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// readKeyTokensFile reads 'key token' pairs, one per line.
+func readKeyTokensFile(fn string) (map[string]string, error) {
+	lines, err := readLines(fn)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: invalid line %q, expected 'key token'", fn, line)
+		}
+		if _, ok := parse(fields[0]); !ok {
+			return nil, fmt.Errorf("%s: invalid key %q", fn, fields[0])
+		}
+		m[fields[0]] = fields[1]
+	}
+	return m, nil
+}
+
+// readLines returns the non-blank lines of a file, skipping # comments.
+func readLines(fn string) ([]string, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
 }
 
 func must[T any](v T, err error) T {
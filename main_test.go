@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setClock makes now return t until the test ends.
+func setClock(tb testing.TB, t time.Time) *time.Time {
+	tb.Helper()
+	clock := t
+	now = func() time.Time { return clock }
+	tb.Cleanup(func() { now = time.Now })
+	return &clock
+}
+
+func TestZeroIntervalKeys(t *testing.T) {
+	for _, key := range []string{"foo-0s", "foo-0ms", "foo-0h0m", "foo-1h-0s", "~foo-0s"} {
+		if _, ok := parse(key); ok {
+			t.Errorf("parse(%q) ok, want invalid", key)
+		}
+	}
+
+	s := newServer()
+	clock := setClock(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	if _, err := s.Checkin("foo-0s", checkinSuccess, "", ""); err != errInvalidKey {
+		t.Fatalf("Checkin(foo-0s) = %v, want %v", err, errInvalidKey)
+	}
+	if _, err := s.Checkin("foo-1s", checkinSuccess, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	*clock = clock.Add(time.Minute)
+	s.evaluate()
+	st, err := s.Status("foo-1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Status != statusAlarm || st.MissedIntervals != 60 {
+		t.Errorf("foo-1s is %s with %d missed intervals, want ALARM with 60", st.Status, st.MissedIntervals)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for key, want := range map[string]limits{
+		"backup-30s":     {alarm: 30 * time.Second},
+		"backup-5m":      {alarm: 5 * time.Minute},
+		"backup-24h":     {alarm: 24 * time.Hour},
+		"backup-1d":      {alarm: 24 * time.Hour},
+		"backup-7d":      {alarm: 7 * 24 * time.Hour},
+		"backup-2w":      {alarm: 14 * 24 * time.Hour},
+		"backup-1w2d":    {alarm: 9 * 24 * time.Hour},
+		"backup-1h30m":   {alarm: 90 * time.Minute},
+		"backup-90s":     {alarm: 90 * time.Second},
+		"backup-1y":      {},
+		"backup-1d1y":    {},
+		"backup-1h1d":    {}, // largest first
+		"backup-1d1d":    {},
+		"backup-1.5d":    {},
+		"backup-d":       {},
+		"backup-1dw":     {},
+		"backup":         {},
+		"backup-1d-36h":  {warn: 24 * time.Hour, alarm: 36 * time.Hour},
+		"backup-1d-1d1h": {warn: 24 * time.Hour, alarm: 25 * time.Hour},
+		"backup-36h-1d":  {alarm: 24 * time.Hour}, // the name is backup-36h
+		"backup-1d-1y":   {},
+	} {
+		got, ok := parse(key)
+		if got != want || ok != (want != limits{}) {
+			t.Errorf("parse(%q) = %+v, %v, want %+v", key, got, ok, want)
+		}
+	}
+}
+
+func TestClockStepBack(t *testing.T) {
+	lim, _ := parse("job-1h")
+	checkin := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	e := entry{lastCheckin: checkin}
+
+	// e.g. an NTP step after a VM resume
+	st := statusOf("job-1h", lim, e, checkin.Add(-3*time.Hour))
+	if st.Status != statusOkay || *st.SinceSeconds != 0 || *st.RemainingSeconds != 3600 {
+		t.Errorf("got %s since %ds remaining %ds, want OKAY since 0s remaining 3600s", st.Status, *st.SinceSeconds, *st.RemainingSeconds)
+	}
+
+	// once the clock is back, the key goes into ALARM as usual
+	st = statusOf("job-1h", lim, e, checkin.Add(2*time.Hour))
+	if st.Status != statusAlarm || *st.SinceSeconds != 7200 {
+		t.Errorf("got %s since %ds, want ALARM since 7200s", st.Status, *st.SinceSeconds)
+	}
+}
+
+func TestFormatSince(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		0:                             "0s",
+		1500 * time.Millisecond:       "1s",
+		59 * time.Second:              "59s",
+		2*time.Minute + 3*time.Second: "2m 3s",
+		2*time.Hour + 5*time.Minute + 3*time.Second: "2h 5m 3s",
+		time.Hour:                        "1h 0m 0s",
+		5 * 24 * time.Hour:               "5d 0h 0m 0s",
+		5*24*time.Hour + 123*time.Second: "5d 0h 2m 3s",
+	} {
+		if got := formatUnits(d); got != want {
+			t.Errorf("formatUnits(%v) = %q, want %q", d, got, want)
+		}
+	}
+	for d, want := range map[time.Duration]string{
+		500 * time.Millisecond:        "just now",
+		time.Second:                   "1 second ago",
+		59 * time.Second:              "59 seconds ago",
+		time.Minute + 59*time.Second:  "1 minute ago",
+		2*time.Hour + 59*time.Minute:  "2 hours ago",
+		5*24*time.Hour + 23*time.Hour: "5 days ago",
+	} {
+		if got := formatRelative(d); got != want {
+			t.Errorf("formatRelative(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestParseIntervalMilliseconds(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"500ms":    500 * time.Millisecond,
+		"500m":     500 * time.Minute,
+		"1s500ms":  1500 * time.Millisecond,
+		"1m1s1ms":  time.Minute + time.Second + time.Millisecond,
+		"1h0ms":    time.Hour,
+		"500ms1s":  0, // largest first
+		"1ms1ms":   0,
+		"1ms500ms": 0,
+		"1s1s":     0,
+		"ms":       0,
+		"5mss":     0,
+		"0ms":      0,
+		"0s0ms":    0,
+		"":         0,
+	} {
+		got, ok := parseInterval(s)
+		if got != want || ok != (want > 0) {
+			t.Errorf("parseInterval(%q) = %v, %v, want %v, %v", s, got, ok, want, want > 0)
+		}
+	}
+
+	if lim, ok := parse("hb-500ms"); !ok || lim.alarm != 500*time.Millisecond {
+		t.Errorf("parse(hb-500ms) = %+v, %v, want half a second", lim, ok)
+	}
+}
+
+// memoryStore counts the saves instead of persisting anything.
+type memoryStore struct{ saves, keys int }
+
+func (m *memoryStore) Load() (*database, error) { return nil, os.ErrNotExist }
+func (m *memoryStore) Save(db *database) error  { m.saves++; return nil }
+func (m *memoryStore) SaveKeys(db *database, keys []string) error {
+	m.saves++
+	m.keys += len(keys)
+	return nil
+}
+
+func TestSaveSkipsClean(t *testing.T) {
+	s := newServer()
+	store := &memoryStore{}
+	s.store = store
+	s.Checkin("a-1h", checkinSuccess, "", "")
+	s.save()
+	s.save()
+	if store.saves != 1 || store.keys != 1 {
+		t.Errorf("got %d saves of %d keys, want 1 save of 1 key", store.saves, store.keys)
+	}
+}
+
+// discardWriter is a ResponseWriter that drops the response, so that the
+// benchmarks only measure the server.
+type discardWriter struct{ h http.Header }
+
+func (w *discardWriter) Header() http.Header         { return w.h }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+const benchKeys = 500
+
+// testServer returns a server taking the adm token, with a memoryStore.
+func testServer() *Server {
+	s := newServer()
+	s.store = &memoryStore{}
+	st := defaultSettings()
+	st.authTokens = []string{"adm"}
+	s.current.Store(st)
+	return s
+}
+
+func benchServer(b *testing.B) (*Server, http.Handler, []string) {
+	s := testServer()
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("job%d-1h", i)
+		for range s.historySize {
+			if _, err := s.Checkin(keys[i], checkinSuccess, "", ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	s.save()
+	return s, s.Handler(), keys
+}
+
+// testRequest returns a request authorized with the adm token, see
+// testServer.
+func testRequest(method, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "Bearer adm")
+	return r
+}
+
+func jsonRequest(method, target string) *http.Request {
+	r := testRequest(method, target)
+	r.Header.Set("Accept", "application/json")
+	return r
+}
+
+// The benchmarks use 500 keys with full histories. On the same machine,
+// before synth-100 and after it:
+//
+//	BenchmarkCheckin  16.5µs  7813 B/op    44 allocs/op  ->  14.0µs  7706 B/op    43 allocs/op
+//	BenchmarkList     2.6ms   550 KB/op  3529 allocs/op  ->  2.3ms   411 KB/op  3528 allocs/op
+//	BenchmarkSave     500µs   470 KB/op   527 allocs/op  ->  60ns       0 B/op     0 allocs/op
+//
+// Allocations per checkin don't depend on the number of keys or the history
+// size.
+
+func BenchmarkCheckin(b *testing.B) {
+	_, h, keys := benchServer(b)
+	w := &discardWriter{h: http.Header{}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range b.N {
+		clear(w.h)
+		h.ServeHTTP(w, jsonRequest("POST", "/"+keys[i%len(keys)]))
+	}
+}
+
+func BenchmarkList(b *testing.B) {
+	_, h, _ := benchServer(b)
+	w := &discardWriter{h: http.Header{}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		clear(w.h)
+		h.ServeHTTP(w, jsonRequest("GET", "/"))
+	}
+}
+
+// BenchmarkSave measures the second of the saves a checkin schedules, see
+// save.
+func BenchmarkSave(b *testing.B) {
+	s, _, _ := benchServer(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		s.save()
+	}
+}
+
+// BenchmarkParallelReads checks in one key for every 15 status reads, all
+// in parallel, as under dashboards polling the keys. Run it with -cpu to see
+// how much reads wait for each other on mu. On a single-CPU machine, it ran
+// at about 15µs/op both with mu a Mutex before synth-99 and with the
+// RWMutex, since nothing runs in parallel there.
+func BenchmarkParallelReads(b *testing.B) {
+	_, h, keys := benchServer(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		w := &discardWriter{h: http.Header{}}
+		for i := 0; pb.Next(); i++ {
+			clear(w.h)
+			key := keys[i%len(keys)]
+			if i%16 == 0 {
+				h.ServeHTTP(w, jsonRequest("POST", "/"+key))
+			} else {
+				h.ServeHTTP(w, jsonRequest("GET", "/"+key))
+			}
+		}
+	})
+}
+
+func TestIntervalBounds(t *testing.T) {
+	s := newServer()
+	st := defaultSettings()
+	st.minInterval, st.maxInterval = time.Minute, 48*time.Hour
+	s.current.Store(st)
+
+	for key, want := range map[string]error{"a-30s": errIntervalBounds, "a-5m": nil, "a-3d": errIntervalBounds} {
+		if _, err := s.Checkin(key, checkinSuccess, "", ""); err != want {
+			t.Errorf("Checkin(%s) = %v, want %v", key, err, want)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/batch", strings.NewReader(`["b-30s", "b-5m", "b-3d"]`))
+	w := httptest.NewRecorder()
+	s.batchHandler(w, r)
+	var results []*batchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("%v in %s", err, w.Body)
+	}
+	for i, want := range []string{"Interval out of range", "", "Interval out of range"} {
+		if results[i].Error != want {
+			t.Errorf("batch checkin of %s got %q, want %q", results[i].Key, results[i].Error, want)
+		}
+	}
+	if _, found := s.checkins["b-3d"]; found {
+		t.Errorf("b-3d got checked in")
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	s := testServer()
+	s.settings().keyGrace = map[string]grace{"late-1h": {d: time.Hour}}
+	h := s.Handler()
+	clock := setClock(t, time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	code := func(key string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, testRequest("GET", "/"+key+"?code=1"))
+		return w.Code
+	}
+	if c := code("never-1h"); c != http.StatusServiceUnavailable {
+		t.Errorf("never checked in key got %d, want 503", c)
+	}
+	s.Checkin("job-1h", checkinSuccess, "", "")
+	s.Checkin("late-1h", checkinSuccess, "", "")
+	if c := code("job-1h"); c != http.StatusOK {
+		t.Errorf("OKAY key got %d, want 200", c)
+	}
+	*clock = clock.Add(90 * time.Minute)
+	if c := code("job-1h"); c != http.StatusServiceUnavailable {
+		t.Errorf("key in ALARM got %d, want 503", c)
+	}
+	if st, _ := s.Status("late-1h"); st.Status != statusLate {
+		t.Fatalf("late-1h is %s, want LATE", st.Status)
+	}
+	if c := code("late-1h"); c != http.StatusServiceUnavailable {
+		t.Errorf("LATE key got %d, want 503", c)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := setClock(t, start)
+	s := testServer()
+	st := defaultSettings()
+	st.gcAfter = 24 * time.Hour
+	st.renotifyAfter = 10 * time.Minute
+	st.checkinRate, st.checkinBurst = 1, 5
+	st.maintenance = []window{must(parseWindow("held-*", "00:00-23:59", nil))}
+	s.current.Store(st)
+	s.intervals["cfg/backup"] = "1h"
+	s.intervals["cfg/job"] = "1h"
+	for _, key := range []string{"old-1h", "held-1h", "cfg/job"} {
+		s.Checkin(key, checkinSuccess, "", "")
+	}
+	*clock = start.Add(2 * time.Hour)
+	s.evaluate()
+	if _, ok := s.reminders["old-1h"]; !ok {
+		t.Fatal("old-1h has no reminders")
+	}
+	if _, ok := s.held["held-1h"]; !ok {
+		t.Fatal("held-1h has no held back alarm")
+	}
+
+	*clock = start.Add(25 * time.Hour)
+	s.Checkin("fresh-1h", checkinSuccess, "", "")
+	s.mu.Lock()
+	collected := s.collectGarbage(now())
+	s.mu.Unlock()
+	slices.Sort(collected)
+	if want := []string{"held-1h", "old-1h"}; !slices.Equal(collected, want) {
+		t.Errorf("collected %v, want %v", collected, want)
+	}
+	for _, key := range []string{"cfg/backup", "cfg/job"} {
+		if _, ok := s.interval(key); !ok {
+			t.Errorf("%s lost its configured interval", key)
+		}
+	}
+	for _, key := range collected {
+		_, reminded := s.reminders[key]
+		_, held := s.held[key]
+		_, limited := s.buckets[key]
+		if reminded || held || limited {
+			t.Errorf("%s left reminders %v, held %v, rate limit %v", key, reminded, held, limited)
+		}
+	}
+	if _, ok := s.buckets["fresh-1h"]; !ok {
+		t.Error("fresh-1h lost its rate limit")
+	}
+}
+
+func TestObserveStaleEntry(t *testing.T) {
+	s := newServer()
+	checkin := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := setClock(t, checkin)
+	s.Checkin("job-1h", checkinSuccess, "", "")
+	lim, _ := s.limits("job-1h")
+
+	// evaluate takes the entries, a checkin lands, then evaluate observes
+	*clock = checkin.Add(2 * time.Hour)
+	s.mu.RLock()
+	stale := s.entryOf("job-1h")
+	s.mu.RUnlock()
+	s.Checkin("job-1h", checkinSuccess, "", "")
+	s.observe("job-1h", lim, stale, now())
+
+	if got := s.states["job-1h"]; got != statusOkay {
+		t.Errorf("job-1h is %s after observing stale data, want OKAY", got)
+	}
+	for len(s.notifications) > 0 {
+		if ev := <-s.notifications; ev.Event == eventAlarm {
+			t.Errorf("got a spurious alarm notification %+v", ev)
+		}
+	}
+}
+
+func TestAlertmanagerRoutes(t *testing.T) {
+	s := testServer()
+	h := s.Handler()
+	for _, target := range []string{"/alertmanager/am-24h", "/am2-24h/alertmanager", "/alertmanager/team/am-24h"} {
+		r := httptest.NewRequest("POST", target, strings.NewReader(`{"status":"resolved"}`))
+		r.Header.Set("Authorization", "Bearer adm")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Errorf("POST %s got %d %s, want 204", target, w.Code, w.Body)
+		}
+	}
+	for _, key := range []string{"am-24h", "am2-24h", "team/am-24h"} {
+		if _, ok := s.checkins[key]; !ok {
+			t.Errorf("%s hasn't checked in", key)
+		}
+	}
+	if validName("alertmanager/am-24h") {
+		t.Error("alertmanager/am-24h is a valid key, but /alertmanager/am-24h checks in am-24h")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// window is a recurring maintenance window, during which alarms of the
+// keys matching pattern don't notify.
+type window struct {
+	pattern    string        // like path.Match
+	start, end time.Duration // since midnight; end < start wraps past midnight
+	days       [7]bool       // weekdays the window starts on; all if none set
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseWindow parses a maintenance window of the config file, like keys
+// batch-*, window 02:00-04:00, days [sat, sun].
+func parseWindow(keys, spec string, days []string) (window, error) {
+	w := window{pattern: keys}
+	if _, err := path.Match(keys, ""); err != nil || keys == "" {
+		return w, fmt.Errorf("invalid keys pattern %q", keys)
+	}
+	from, to, ok := strings.Cut(spec, "-")
+	start, err1 := time.Parse("15:04", strings.TrimSpace(from))
+	end, err2 := time.Parse("15:04", strings.TrimSpace(to))
+	if !ok || err1 != nil || err2 != nil || start.Equal(end) {
+		return w, fmt.Errorf("invalid window %q, must be like 02:00-04:00", spec)
+	}
+	w.start = time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute
+	w.end = time.Duration(end.Hour())*time.Hour + time.Duration(end.Minute())*time.Minute
+	for _, d := range days {
+		wd, ok := weekdays[strings.ToLower(d)[:min(3, len(d))]]
+		if !ok {
+			return w, fmt.Errorf("invalid day %q", d)
+		}
+		w.days[wd] = true
+	}
+	return w, nil
+}
+
+// active reports whether the window covers key at t, given in the
+// display time zone.
+func (w *window) active(key string, t time.Time) bool {
+	if ok, _ := path.Match(w.pattern, key); !ok {
+		return false
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	since := t.Sub(midnight)
+	day := t.Weekday()
+	switch {
+	case w.start < w.end:
+		if since < w.start || since >= w.end {
+			return false
+		}
+	case since >= w.start:
+	case since < w.end:
+		day = (day + 6) % 7 // started yesterday
+	default:
+		return false
+	}
+	return w.days == [7]bool{} || w.days[day]
+}
+
+// inMaintenance reports whether a maintenance window covers key at t.
+func (s *Server) inMaintenance(key string, t time.Time) bool {
+	t = t.In(s.location)
+	windows := s.settings().maintenance
+	for i := range windows {
+		if windows[i].active(key, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// holdForMaintenance reports whether ev must not be sent because of a
+// maintenance window. Alarms and warnings are held back until the window
+// ends, and dropped if the key recovers before that, see endMaintenance.
+// Must be called with mu held.
+func (s *Server) holdForMaintenance(ev *event) bool {
+	_, held := s.held[ev.Key]
+	if ev.Event == eventRecovery {
+		// nobody has been told about the alarm
+		delete(s.held, ev.Key)
+		return held
+	}
+	if !s.inMaintenance(ev.Key, now()) {
+		return false
+	}
+	s.held[ev.Key] = ev
+	return true
+}
+
+// endMaintenance sends the held back notifications of the keys whose
+// maintenance windows are over, if they still have the same status.
+func (s *Server) endMaintenance(now time.Time) {
+	var evs []*event
+	s.mu.Lock()
+	for key, ev := range s.held {
+		if s.inMaintenance(key, now) {
+			continue
+		}
+		delete(s.held, key)
+		if status := s.states[key]; !(ev.Event == eventAlarm && status == statusAlarm) && !(ev.Event == eventWarn && status == statusWarn) {
+			continue
+		}
+		lim, _ := s.limits(key)
+		ev.since = now.Sub(ev.LastCheckin)
+		if ev.Event == eventWarn {
+			ev.OverdueSeconds = int64((ev.since - lim.warn).Seconds())
+		} else if !lim.inverse {
+			ev.OverdueSeconds = int64((ev.since - lim.alarm).Seconds())
+		}
+		if _, ok := s.reminders[key]; ok {
+			s.reminders[key] = reminder{last: now}
+		}
+		evs = append(evs, ev)
+	}
+	s.mu.Unlock()
+
+	for _, ev := range evs {
+		s.queueNotification(ev)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceHold(t *testing.T) {
+	s := testServer()
+	st := defaultSettings()
+	st.renotifyAfter = 10 * time.Minute
+	st.maintenance = []window{must(parseWindow("batch-*", "02:00-04:00", nil))}
+	s.current.Store(st)
+	start := time.Date(2026, 1, 1, 0, 30, 0, 0, time.UTC)
+	clock := setClock(t, start)
+	notified := func() map[string]*event {
+		evs := make(map[string]*event)
+		for len(s.notifications) > 0 {
+			ev := <-s.notifications
+			evs[ev.Key] = ev
+		}
+		return evs
+	}
+	for _, key := range []string{"batch-export-1h", "batch-import-1h", "web-1h"} {
+		s.Checkin(key, checkinSuccess, "", "")
+	}
+
+	*clock = start.Add(2 * time.Hour) // 02:30
+	s.evaluate()
+	if evs := notified(); len(evs) != 1 || evs["web-1h"] == nil {
+		t.Fatalf("notified %v in the window, want only web-1h", evs)
+	}
+	*clock = start.Add(150 * time.Minute)
+	s.Checkin("batch-import-1h", checkinSuccess, "", "")
+	s.evaluate()
+	*clock = start.Add(170 * time.Minute)
+	s.evaluate()
+	if evs := notified(); len(evs) != 1 || evs["web-1h"] == nil || evs["web-1h"].Reminder == 0 {
+		t.Fatalf("notified %v in the window, want only the reminders about web-1h", evs)
+	}
+
+	*clock = start.Add(210 * time.Minute) // 04:00
+	s.evaluate()
+	evs := notified()
+	if ev := evs["batch-export-1h"]; ev == nil || ev.Event != eventAlarm || ev.OverdueSeconds != 150*60 {
+		t.Errorf("got %+v after the window, want the held back alarm about batch-export-1h", ev)
+	}
+	if ev := evs["batch-import-1h"]; ev != nil {
+		t.Errorf("got %+v, but batch-import-1h recovered in the window", ev)
+	}
+	*clock = start.Add(215 * time.Minute)
+	s.evaluate()
+	if evs := notified(); evs["batch-export-1h"] != nil {
+		t.Errorf("reminded about batch-export-1h right after the window: %+v", evs["batch-export-1h"])
+	}
+	*clock = start.Add(230 * time.Minute)
+	s.evaluate()
+	if ev := notified()["batch-export-1h"]; ev == nil || ev.Reminder != 1 {
+		t.Errorf("got %+v, want the first reminder about batch-export-1h 10m after it was released", ev)
+	}
+}
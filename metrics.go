@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	neturl "net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.writeMetrics(w)
+}
+
+// metricStatuses returns the statuses of all keys, sorted by key.
+func (s *Server) metricStatuses() []*keyStatus {
+	s.mu.RLock()
+	m := s.entries()
+	s.mu.RUnlock()
+
+	now := now()
+	keys := slices.Sorted(maps.Keys(m))
+	statuses := make([]*keyStatus, 0, len(keys))
+	for _, key := range keys {
+		lim, _ := s.limits(key)
+		statuses = append(statuses, s.observe(key, lim, m[key], now))
+	}
+	return statuses
+}
+
+// isUp reports whether a key with the given status counts as up in the
+// metrics. Acknowledged alarms are still down.
+func isUp(status string) bool {
+	return status == statusOkay || status == statusWarn || status == statusLate
+}
+
+// writeMetrics writes the gauges in the Prometheus text format.
+func (s *Server) writeMetrics(w io.Writer) {
+	statuses := s.metricStatuses()
+	fmt.Fprintf(w, "# HELP watchdog_keys_total Number of known watchdog keys.\n")
+	fmt.Fprintf(w, "# TYPE watchdog_keys_total gauge\n")
+	fmt.Fprintf(w, "watchdog_keys_total %d\n", len(statuses))
+
+	fmt.Fprintf(w, "# HELP watchdog_seconds_since_checkin Seconds since the last checkin of the key.\n")
+	fmt.Fprintf(w, "# TYPE watchdog_seconds_since_checkin gauge\n")
+	for _, st := range statuses {
+		fmt.Fprintf(w, "watchdog_seconds_since_checkin{key=\"%s\"} %.3f\n", promLabelEscaper.Replace(st.Key), st.since.Seconds())
+	}
+
+	fmt.Fprintf(w, "# HELP watchdog_up 1 if the key is OKAY, WARN or LATE, 0 if it is in ALARM (including acknowledged alarms).\n")
+	fmt.Fprintf(w, "# TYPE watchdog_up gauge\n")
+	for _, st := range statuses {
+		up := 0
+		if isUp(st.Status) {
+			up = 1
+		}
+		fmt.Fprintf(w, "watchdog_up{key=\"%s\"} %d\n", promLabelEscaper.Replace(st.Key), up)
+	}
+
+	fmt.Fprintf(w, "# HELP watchdog_missed_intervals Number of whole thresholds that passed since the last checkin of the key, 0 while OKAY.\n")
+	fmt.Fprintf(w, "# TYPE watchdog_missed_intervals gauge\n")
+	for _, st := range statuses {
+		fmt.Fprintf(w, "watchdog_missed_intervals{key=\"%s\"} %d\n", promLabelEscaper.Replace(st.Key), st.MissedIntervals)
+	}
+}
+
+// pusher pushes the metrics to the Pushgateway every pushInterval. Failed
+// pushes are retried on the next cycle.
+func (s *Server) pusher() {
+	ticker := time.NewTicker(s.pushInterval)
+	defer ticker.Stop()
+	failing := false
+	for range ticker.C {
+		err := s.push()
+		if err != nil && !failing {
+			logEvent(slog.LevelError, "push_failed", fmt.Sprintf("pushing metrics to the Pushgateway failed, will retry: %v", err), "error", err)
+		} else if err == nil && failing {
+			logEvent(slog.LevelInfo, "push_recovered", "pushing metrics to the Pushgateway works again")
+		}
+		failing = err != nil
+	}
+}
+
+// push replaces the metrics of the job in the Pushgateway.
+func (s *Server) push() error {
+	var buf bytes.Buffer
+	s.writeMetrics(&buf)
+	u := strings.TrimSuffix(s.pushURL, "/") + "/metrics/job/" + neturl.PathEscape(s.pushJob)
+	req, err := http.NewRequest(http.MethodPut, u, &buf)
+	if err != nil {
+		return errors.New("invalid -pushgateway-url")
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		// the URL can carry credentials
+		var uerr *neturl.Error
+		if errors.As(err, &uerr) {
+			return uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	eventWarn     = "warn"
+	eventAlarm    = "alarm"
+	eventRecovery = "recovery"
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+type event struct {
+	Event          string    `json:"event"`
+	Key            string    `json:"key"`
+	LastCheckin    time.Time `json:"last_checkin"`
+	OverdueSeconds int64     `json:"overdue_seconds"`
+	AlarmSeconds   int64     `json:"alarm_seconds,omitempty"`
+	Reminder       int       `json:"reminder,omitempty"`   // number of the repeated alarm notification
+	Suppressed     int       `json:"suppressed,omitempty"` // notifications held back by the cooldown, this one included
+	Failed         bool      `json:"failed,omitempty"`     // the alarm is due to a /fail checkin rather than missed ones
+
+	since time.Duration
+}
+
+// destination is where the notifications about a key go.
+type destination struct {
+	webhookURL      string
+	slackWebhookURL string
+	mailTo          string
+}
+
+// route sends the notifications about the keys starting with prefix, or
+// about the key equal to it if exact is set, to their own destination.
+type route struct {
+	prefix string
+	exact  bool
+	destination
+}
+
+// destination returns the destination of the notifications about key: that
+// of its exact route, or the longest matching prefix route, or the global
+// one.
+func (st *settings) destination(key string) destination {
+	var best *route
+	for i := range st.routes {
+		r := &st.routes[i]
+		if r.exact {
+			if r.prefix == key {
+				return r.destination
+			}
+		} else if strings.HasPrefix(key, r.prefix) && (best == nil || len(r.prefix) > len(best.prefix)) {
+			best = r
+		}
+	}
+	if best != nil {
+		return best.destination
+	}
+	return destination{webhookURL: st.webhookURL, slackWebhookURL: st.slackWebhookURL, mailTo: st.mailTo}
+}
+
+// onTransition is called whenever a key changes its status.
+func (s *Server) onTransition(tr transition, lim limits, e entry, since time.Duration) {
+	s.events.publish(&statusChange{Key: tr.Key, From: tr.From, Status: tr.To, At: tr.At})
+
+	ev := &event{
+		Key:         tr.Key,
+		LastCheckin: e.lastCheckin,
+		since:       since,
+	}
+	switch {
+	case tr.To == statusAlarm:
+		ev.Event = eventAlarm
+		ev.setAlarmCause(lim, !e.failedAt.IsZero())
+	case tr.To == statusWarn:
+		ev.Event = eventWarn
+		ev.OverdueSeconds = int64((since - lim.warn).Seconds())
+	case tr.To == statusOkay && (tr.From == statusAlarm || tr.From == statusWarn || tr.From == statusAcked):
+		ev.Event = eventRecovery
+		if !tr.AlarmSince.IsZero() {
+			ev.AlarmSeconds = int64(tr.At.Sub(tr.AlarmSince).Seconds())
+		}
+	default:
+		return
+	}
+	s.mu.Lock()
+	held := s.holdForMaintenance(ev)
+	s.mu.Unlock()
+	if held {
+		logEvent(slog.LevelInfo, "notification_held", fmt.Sprintf("%s: %s notification held back by a maintenance window", ev.Key, ev.Event),
+			"key", ev.Key, "event", ev.Event)
+		return
+	}
+	s.queueNotification(ev)
+}
+
+// setAlarmCause records why the key of an alarm event is in ALARM. Failed
+// runs aren't overdue, their last checkin being the failure itself.
+func (ev *event) setAlarmCause(lim limits, failed bool) {
+	switch {
+	case failed:
+		ev.Failed = true
+	case !lim.inverse:
+		ev.OverdueSeconds = int64((ev.since - lim.alarm).Seconds())
+	}
+}
+
+// queueNotification passes ev to the notifier without blocking, so that
+// slow receivers can't hold up the evaluation of the keys.
+func (s *Server) queueNotification(ev *event) {
+	select {
+	case s.notifications <- ev:
+	default:
+		logEvent(slog.LevelError, "notification_dropped", fmt.Sprintf("too many pending notifications, dropping %s notification for %s", ev.Event, ev.Key),
+			"key", ev.Key, "event", ev.Event)
+	}
+}
+
+// reminder tracks the repeated notifications about a key in ALARM.
+type reminder struct {
+	last  time.Time // of the last notification
+	count int
+}
+
+// remind notifies again about the keys that are still in ALARM
+// renotifyAfter after the last notification, doubling the interval every
+// time. Reminders are only tracked in memory: after a restart, the first
+// one comes renotifyAfter after the start.
+func (s *Server) remind(now time.Time) {
+	st := s.settings()
+	var evs []*event
+	s.mu.Lock()
+	for key := range s.reminders {
+		if s.states[key] != statusAlarm {
+			delete(s.reminders, key) // includes acknowledged alarms
+		}
+	}
+	for key, status := range s.states {
+		if status != statusAlarm || st.renotifyAfter <= 0 {
+			continue
+		}
+		if _, held := s.held[key]; held || s.inMaintenance(key, now) {
+			continue
+		}
+		r, ok := s.reminders[key]
+		if !ok {
+			s.reminders[key] = reminder{last: now}
+			continue
+		}
+		if (st.renotifyMax > 0 && r.count >= st.renotifyMax) || now.Sub(r.last) < st.renotifyAfter<<r.count {
+			continue
+		}
+		r.last, r.count = now, r.count+1
+		s.reminders[key] = r
+
+		lim, _ := s.limits(key)
+		last := s.checkins[key]
+		ev := &event{Event: eventAlarm, Key: key, LastCheckin: last, since: now.Sub(last), Reminder: r.count}
+		_, failed := s.failures[key]
+		ev.setAlarmCause(lim, failed)
+		evs = append(evs, ev)
+	}
+	s.mu.Unlock()
+
+	for _, ev := range evs {
+		s.queueNotification(ev)
+	}
+}
+
+// cooldown holds back the notifications about a key for a while after one
+// has been sent, so that a flapping key doesn't flood the channels.
+type cooldown struct {
+	until      time.Time
+	suppressed int
+	latest     *event // the last suppressed one
+}
+
+// cooldowns are the cooldowns of the keys, only used by the notifier
+// goroutine. When a cooldown is over, the latest suppressed notification
+// is sent, with the number of suppressed ones, and starts another cooldown.
+type cooldowns map[string]*cooldown
+
+// admit reports whether ev is to be sent now, and if so starts a cooldown
+// of d for its key. Otherwise, ev is held back until the cooldown ends.
+func (cs cooldowns) admit(ev *event, now time.Time, d time.Duration) bool {
+	c := cs[ev.Key]
+	if c != nil && now.Before(c.until) {
+		c.suppressed++
+		c.latest = ev
+		logEvent(slog.LevelInfo, "notification_suppressed", fmt.Sprintf("%s: %s notification held back until the cooldown ends", ev.Key, ev.Event),
+			"key", ev.Key, "event", ev.Event, "until", c.until)
+		return false
+	}
+	delete(cs, ev.Key)
+	if c != nil && c.suppressed > 0 {
+		ev.Suppressed = c.suppressed + 1 // not flushed by due yet
+	}
+	cs.start(ev.Key, now, d)
+	return true
+}
+
+// due returns the latest suppressed notifications of the cooldowns that
+// are over, starting another cooldown of d for their keys.
+func (cs cooldowns) due(now time.Time, d time.Duration) []*event {
+	var evs []*event
+	for key, c := range cs {
+		if now.Before(c.until) {
+			continue
+		}
+		delete(cs, key)
+		if c.suppressed > 0 {
+			c.latest.Suppressed = c.suppressed
+			evs = append(evs, c.latest)
+			cs.start(key, now, d)
+		}
+	}
+	return evs
+}
+
+func (cs cooldowns) start(key string, now time.Time, d time.Duration) {
+	if d > 0 {
+		cs[key] = &cooldown{until: now.Add(d)}
+	}
+}
+
+func (s *Server) notifier() {
+	// Emails that failed to send are retried on every evaluation cycle.
+	var pendingMail []*event
+	deliver := func(ev *event) {
+		s.notify(ev)
+		if s.mailEnabled(ev) {
+			pendingMail = append(pendingMail, ev)
+			pendingMail = s.deliverMail(pendingMail)
+		}
+	}
+
+	cooling := make(cooldowns)
+
+	retry := time.NewTicker(s.checkInterval)
+	defer retry.Stop()
+	webhookRetry := time.NewTimer(0)
+	<-webhookRetry.C
+	for {
+		webhookRetry.Stop()
+		if next := s.nextWebhookRetry(); !next.IsZero() {
+			webhookRetry.Reset(max(0, time.Until(next)))
+		}
+		select {
+		case <-webhookRetry.C:
+			s.retryWebhooks()
+		case ev := <-s.notifications:
+			if cooling.admit(ev, now(), s.settings().notifyCooldown) {
+				deliver(ev)
+			}
+		case <-retry.C:
+			for _, ev := range cooling.due(now(), s.settings().notifyCooldown) {
+				deliver(ev)
+			}
+			if len(pendingMail) > 0 {
+				pendingMail = s.deliverMail(pendingMail)
+			}
+		}
+	}
+}
+
+// deliverMail sends the pending emails in order, returning the ones that
+// couldn't be delivered.
+func (s *Server) deliverMail(pending []*event) []*event {
+	for len(pending) > 0 {
+		ev := pending[0]
+		err := s.sendMail(ev)
+		if err != nil {
+			logEvent(slog.LevelError, "email_failed", fmt.Sprintf("sending email via %s failed for %s (%d pending), will retry: %v", s.settings().smtpHost, ev.Key, len(pending), err),
+				"key", ev.Key, "smtp_host", s.settings().smtpHost, "pending", len(pending), "error", err)
+			if len(pending) > maxPendingMail {
+				log.Printf("too many pending emails, dropping %d oldest", len(pending)-maxPendingMail)
+				pending = pending[len(pending)-maxPendingMail:]
+			}
+			return pending
+		}
+		pending = pending[1:]
+	}
+	return nil
+}
+
+func (s *Server) notify(ev *event) {
+	switch ev.Event {
+	case eventWarn:
+		logEvent(slog.LevelWarn, "warn", fmt.Sprintf("WARN: %s, last checkin %s%s", ev.Key, ev.LastCheckin.Format(time.RFC3339), suppressedText(ev)),
+			"key", ev.Key, "status", statusWarn, "last_checkin", ev.LastCheckin, "overdue_seconds", ev.OverdueSeconds, "suppressed", ev.Suppressed)
+	case eventAlarm:
+		msg := fmt.Sprintf("ALARM: %s, last checkin %s", ev.Key, ev.LastCheckin.Format(time.RFC3339))
+		if ev.Failed {
+			msg = fmt.Sprintf("ALARM: %s, the run failed at %s", ev.Key, ev.LastCheckin.Format(time.RFC3339))
+		}
+		if ev.Reminder > 0 {
+			msg += fmt.Sprintf(", still down (reminder #%d)", ev.Reminder)
+		}
+		logEvent(slog.LevelWarn, "alarm", msg+suppressedText(ev),
+			"key", ev.Key, "status", statusAlarm, "last_checkin", ev.LastCheckin, "overdue_seconds", ev.OverdueSeconds, "reminder", ev.Reminder, "suppressed", ev.Suppressed)
+	case eventRecovery:
+		logEvent(slog.LevelInfo, "recovery", fmt.Sprintf("RECOVERED: %s after %ds in alarm%s", ev.Key, ev.AlarmSeconds, suppressedText(ev)),
+			"key", ev.Key, "status", statusOkay, "last_checkin", ev.LastCheckin, "alarm_seconds", ev.AlarmSeconds, "suppressed", ev.Suppressed)
+	}
+	st := s.settings()
+	if st.execCommand != "" && ev.Event == eventAlarm {
+		go s.runExec(ev, st)
+	}
+	dest := st.destination(ev.Key)
+	if dest.webhookURL != "" {
+		s.postWebhook("webhook", dest.webhookURL, st.webhookSecret, ev.Key, ev)
+	}
+	if dest.slackWebhookURL != "" {
+		s.postWebhook("slack webhook", dest.slackWebhookURL, "", ev.Key, &slackMessage{Text: slackText(ev) + suppressedText(ev)})
+	}
+}
+
+// runExec runs the -exec command for an alarm, passing the details via
+// environment variables.
+func (s *Server) runExec(ev *event, st *settings) {
+	ctx, cancel := context.WithTimeout(context.Background(), st.execTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", st.execCommand)
+	cmd.Env = append(execEnv(os.Environ()),
+		"WATCHDOG_KEY="+ev.Key,
+		"WATCHDOG_STATUS="+statusAlarm,
+		"WATCHDOG_SINCE_SECONDS="+strconv.FormatInt(int64(ev.since.Seconds()), 10),
+	)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		logEvent(slog.LevelError, "exec_failed", fmt.Sprintf("-exec command failed for %s: %v", ev.Key, err), "key", ev.Key, "error", err)
+	}
+}
+
+// execEnvVars are the variables of the server's environment that -exec
+// commands get. The rest, WATCHDOG_* in particular, can hold tokens and
+// passwords.
+var execEnvVars = []string{"PATH", "HOME", "USER", "LOGNAME", "SHELL", "LANG", "TZ", "TMPDIR"}
+
+// execEnv filters environ down to execEnvVars and the locale settings.
+func execEnv(environ []string) []string {
+	var env []string
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if slices.Contains(execEnvVars, name) || strings.HasPrefix(name, "LC_") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// suppressedText mentions the notifications that the cooldown held back.
+func suppressedText(ev *event) string {
+	if ev.Suppressed == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (the latest of %d changes during the cooldown)", ev.Suppressed)
+}
+
+// sign returns the hex HMAC-SHA256 of the timestamp and the body, joined
+// with a dot, so that a captured request can't be replayed later with
+// a new timestamp.
+func sign(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+func slackText(ev *event) string {
+	last := ev.LastCheckin.Format(time.RFC3339)
+	switch ev.Event {
+	case eventWarn:
+		overdue := time.Duration(ev.OverdueSeconds) * time.Second
+		return fmt.Sprintf("🟡 key `%s` is WARN, approaching its deadline, last seen %s ago (%s), past the warning threshold by %s", ev.Key, ev.since.Round(time.Second), last, overdue)
+	case eventAlarm:
+		if ev.Failed {
+			if ev.Reminder > 0 {
+				return fmt.Sprintf("🔴 key `%s` is still FAILED, the run failed %s ago (%s)", ev.Key, ev.since.Round(time.Second), last)
+			}
+			return fmt.Sprintf("🔴 key `%s` FAILED at %s", ev.Key, last)
+		}
+		overdue := time.Duration(ev.OverdueSeconds) * time.Second
+		if ev.Reminder > 0 {
+			return fmt.Sprintf("🔴 key `%s` is still DOWN, last seen %s ago (%s), overdue by %s", ev.Key, ev.since.Round(time.Second), last, overdue)
+		}
+		return fmt.Sprintf("🔴 key `%s` is DOWN, last seen %s ago (%s), overdue by %s", ev.Key, ev.since.Round(time.Second), last, overdue)
+	case eventRecovery:
+		if ev.AlarmSeconds == 0 {
+			return fmt.Sprintf("🟢 key `%s` is back UP, last seen %s", ev.Key, last)
+		}
+		return fmt.Sprintf("🟢 key `%s` is back UP after %s in alarm, last seen %s", ev.Key, time.Duration(ev.AlarmSeconds)*time.Second, last)
+	default:
+		return fmt.Sprintf("key `%s`: %s", ev.Key, ev.Event)
+	}
+}
+
+// postJSON posts payload to url. With a secret, the request is signed like
+// the X-Watchdog-Signature header described in the README.
+func postJSON(url string, payload any, secret string) error {
+	body := must(json.Marshal(payload))
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.New("invalid URL") // which might embed a secret
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		ts := strconv.FormatInt(now().Unix(), 10)
+		req.Header.Set("X-Watchdog-Timestamp", ts)
+		req.Header.Set("X-Watchdog-Signature", "sha256="+sign(secret, ts, body))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		// Don't let the URL, which often embeds a secret, end up in the logs.
+		var uerr *neturl.Error
+		if errors.As(err, &uerr) {
+			return uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecEnv(t *testing.T) {
+	t.Setenv("WATCHDOG_TOKEN", "secret")
+	t.Setenv("WATCHDOG_SMTP_PASS", "secret")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("LC_ALL", "C")
+	out := filepath.Join(t.TempDir(), "env")
+	s := newServer()
+	st := defaultSettings()
+	st.execCommand = "env > " + out
+	st.execTimeout = 10 * time.Second
+	s.runExec(&event{Key: "job-1h", since: time.Minute}, st)
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for _, kv := range env {
+		if strings.Contains(kv, "secret") {
+			t.Errorf("-exec got %s", kv)
+		}
+	}
+	for _, want := range []string{"WATCHDOG_KEY=job-1h", "WATCHDOG_STATUS=ALARM", "WATCHDOG_SINCE_SECONDS=60", "LC_ALL=C", "PATH=" + os.Getenv("PATH")} {
+		if !slices.Contains(env, want) {
+			t.Errorf("-exec didn't get %s in %q", want, env)
+		}
+	}
+}
+
+func TestWarnText(t *testing.T) {
+	ev := &event{Key: "job-1h", Event: eventWarn, since: 50 * time.Minute, OverdueSeconds: 5 * 60}
+	if text := slackText(ev); strings.Contains(text, "LATE") || !strings.Contains(text, "is WARN") {
+		t.Errorf("slack warn text is %q", text)
+	}
+}
+
+func TestAckedRecovery(t *testing.T) {
+	s := testServer()
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := setClock(t, start)
+	s.Checkin("job-1h", checkinSuccess, "", "")
+	*clock = start.Add(2 * time.Hour)
+	s.evaluate()
+	if err := s.Ack("job-1h", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	s.evaluate()
+	if got := s.states["job-1h"]; got != statusAcked {
+		t.Fatalf("job-1h is %s, want ACKED", got)
+	}
+	for len(s.notifications) > 0 {
+		<-s.notifications
+	}
+
+	*clock = start.Add(150 * time.Minute)
+	s.Checkin("job-1h", checkinSuccess, "", "")
+	s.evaluate()
+	var recovery *event
+	for len(s.notifications) > 0 {
+		if ev := <-s.notifications; ev.Event == eventRecovery {
+			recovery = ev
+		}
+	}
+	if recovery == nil {
+		t.Fatal("no recovery notification after an acknowledged alarm")
+	}
+	if want := int64((90 * time.Minute).Seconds()); recovery.AlarmSeconds != want {
+		t.Errorf("AlarmSeconds = %d, want %d", recovery.AlarmSeconds, want)
+	}
+
+	// acknowledged while in WARN, before the deadline
+	s.Checkin("job-30m-1h", checkinSuccess, "", "")
+	*clock = start.Add(195 * time.Minute)
+	s.evaluate()
+	if err := s.Ack("job-30m-1h", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	s.evaluate()
+	if got, since := s.states["job-30m-1h"], s.stateSince["job-30m-1h"]; got != statusAcked || !since.Equal(now()) {
+		t.Fatalf("job-30m-1h is %s since %v, want ACKED since %v", got, since, now())
+	}
+	for len(s.notifications) > 0 {
+		<-s.notifications
+	}
+	*clock = start.Add(200 * time.Minute)
+	s.Checkin("job-30m-1h", checkinSuccess, "", "")
+	s.evaluate()
+	recovery = nil
+	for len(s.notifications) > 0 {
+		if ev := <-s.notifications; ev.Event == eventRecovery {
+			recovery = ev
+		}
+	}
+	if recovery == nil || recovery.AlarmSeconds != 300 {
+		t.Errorf("got recovery %+v, want one after 300s", recovery)
+	}
+}
+
+func TestFailedAlarm(t *testing.T) {
+	s := testServer()
+	st := defaultSettings()
+	st.renotifyAfter = 10 * time.Minute
+	s.current.Store(st)
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := setClock(t, start)
+	s.Checkin("job-1h", checkinSuccess, "", "")
+	*clock = start.Add(10 * time.Minute)
+	s.Checkin("job-1h", checkinFail, "", "")
+	s.evaluate()
+
+	ev := <-s.notifications
+	if ev.Event != eventAlarm || !ev.Failed || ev.OverdueSeconds != 0 {
+		t.Fatalf("got %+v, want a failed alarm with no overdue time", ev)
+	}
+	if text := slackText(ev); text != "🔴 key `job-1h` FAILED at 2026-01-01T12:10:00Z" {
+		t.Errorf("slack text is %q", text)
+	}
+
+	s.remind(now()) // starts the reminders
+	*clock = start.Add(25 * time.Minute)
+	s.remind(now())
+	ev = <-s.notifications
+	if ev.Reminder != 1 || !ev.Failed || ev.OverdueSeconds != 0 {
+		t.Fatalf("got reminder %+v, want a failed one with no overdue time", ev)
+	}
+	if text := slackText(ev); text != "🔴 key `job-1h` is still FAILED, the run failed 15m0s ago (2026-01-01T12:10:00Z)" {
+		t.Errorf("slack reminder text is %q", text)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	setClock(t, time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	var got struct {
+		ts, sig string
+		body    []byte
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.ts, got.sig = r.Header.Get("X-Watchdog-Timestamp"), r.Header.Get("X-Watchdog-Signature")
+		got.body, _ = io.ReadAll(r.Body)
+	}))
+	defer ts.Close()
+
+	ev := &event{Event: eventAlarm, Key: "job-1h", OverdueSeconds: 60}
+	if err := postJSON(ts.URL, ev, "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	if got.ts != "1767268800" {
+		t.Errorf("X-Watchdog-Timestamp = %q, want the Unix time", got.ts)
+	}
+	// what a receiver does, as described in the README
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(got.ts + "." + string(got.body)))
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); !hmac.Equal([]byte(got.sig), []byte(want)) {
+		t.Errorf("X-Watchdog-Signature = %q, want %q", got.sig, want)
+	}
+
+	if err := postJSON(ts.URL, ev, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got.ts != "" || got.sig != "" {
+		t.Errorf("unsigned webhook got timestamp %q and signature %q", got.ts, got.sig)
+	}
+}
+
+func TestNotifyCooldown(t *testing.T) {
+	s := testServer()
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := setClock(t, start)
+	cooling := make(cooldowns)
+	sent := func() (evs []*event) {
+		for len(s.notifications) > 0 {
+			if ev := <-s.notifications; cooling.admit(ev, now(), 5*time.Minute) {
+				evs = append(evs, ev)
+			}
+		}
+		return evs
+	}
+	checkin := func(at time.Duration, kind string) {
+		*clock = start.Add(at)
+		s.Checkin("job-1h", kind, "", "")
+		s.evaluate()
+	}
+
+	s.Checkin("job-1h", checkinSuccess, "", "")
+	checkin(time.Minute, checkinFail)
+	if evs := sent(); len(evs) != 1 || evs[0].Event != eventAlarm || evs[0].Suppressed != 0 {
+		t.Fatalf("sent %+v, want the first alarm", evs)
+	}
+	checkin(2*time.Minute, checkinSuccess)
+	checkin(3*time.Minute, checkinFail)
+	if evs := sent(); len(evs) != 0 {
+		t.Fatalf("sent %+v during the cooldown", evs)
+	}
+	if evs := cooling.due(start.Add(5*time.Minute), 5*time.Minute); len(evs) != 0 {
+		t.Fatalf("due %+v during the cooldown", evs)
+	}
+	evs := cooling.due(start.Add(6*time.Minute), 5*time.Minute)
+	if len(evs) != 1 || evs[0].Event != eventAlarm || evs[0].Suppressed != 2 {
+		t.Fatalf("due %+v, want the latest alarm of 2", evs)
+	}
+
+	// another cooldown has started, ended, but not been flushed yet
+	checkin(7*time.Minute, checkinSuccess)
+	if evs := sent(); len(evs) != 0 {
+		t.Fatalf("sent %+v during the second cooldown", evs)
+	}
+	checkin(12*time.Minute, checkinFail)
+	if evs := sent(); len(evs) != 1 || evs[0].Event != eventAlarm || evs[0].Suppressed != 2 {
+		t.Fatalf("sent %+v, want an alarm counting the held back recovery", evs)
+	}
+	if evs := cooling.due(start.Add(time.Hour), 5*time.Minute); len(evs) != 0 {
+		t.Errorf("due %+v with nothing held back", evs)
+	}
+}
+
+func TestNotifyRoutes(t *testing.T) {
+	received := make(map[string][]string)
+	receiver := func(name string) string {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var ev event
+			if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+				t.Error(err)
+			}
+			received[name] = append(received[name], ev.Key)
+		}))
+		t.Cleanup(ts.Close)
+		return ts.URL
+	}
+	fn := filepath.Join(t.TempDir(), "watchdog.yaml")
+	cfg := `
+keys:
+  db-backup-1h:
+    webhook: ` + receiver("exact") + `
+  db-vacuum-1h:
+    token: t0ken
+routes:
+  - prefix: db-
+    webhook: ` + receiver("db") + `
+  - prefix: db-backup-
+    webhook: ` + receiver("backups") + `
+`
+	if err := os.WriteFile(fn, []byte(cfg), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := testServer()
+	st := defaultSettings()
+	if _, err := configure(flag.NewFlagSet("watchdogd", flag.ContinueOnError), []string{"-config", fn, "-webhook", receiver("global")}, s, st); err != nil {
+		t.Fatal(err)
+	}
+	s.current.Store(st)
+
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := setClock(t, start)
+	keys := []string{"db-backup-1h", "db-backup-logs-1h", "db-vacuum-1h", "dbx-1h", "web-1h"}
+	for _, key := range keys {
+		s.Checkin(key, checkinSuccess, "", "")
+	}
+	*clock = start.Add(2 * time.Hour)
+	s.evaluate()
+	for len(s.notifications) > 0 {
+		s.notify(<-s.notifications)
+	}
+	for name := range received {
+		slices.Sort(received[name])
+	}
+	want := map[string][]string{
+		"exact":   {"db-backup-1h"},
+		"backups": {"db-backup-logs-1h"},
+		"db":      {"db-vacuum-1h"},
+		"global":  {"dbx-1h", "web-1h"},
+	}
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("received %v, want %v", received, want)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is a no-op until setupTracing installs a tracer provider.
+var tracer = otel.Tracer("github.com/andreyvit/watchdogd")
+
+// setupTracing exports spans to the OTLP/HTTP collector at endpoint, like
+// http://collector:4318, and returns a function flushing the pending spans.
+func setupTracing(endpoint string) (func(context.Context) error, error) {
+	u, err := neturl.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid -otel-endpoint %q, must be like http://collector:4318", endpoint)
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = "/v1/traces"
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, fmt.Errorf("-otel-endpoint: %w", err)
+	}
+	res := resource.NewSchemaless(semconv.ServiceName("watchdogd"), semconv.ServiceVersion(buildVersion().Version))
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// traced creates server spans for the requests, continuing the traces of
+// the callers.
+func traced(handler http.Handler) http.Handler {
+	return otelhttp.NewHandler(handler, "watchdogd", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return r.Method + " " + r.Pattern
+	}))
+}
+
+// startSpan starts a span about key within the request span.
+func startSpan(r *http.Request, name, key string) trace.Span {
+	_, span := tracer.Start(r.Context(), name, trace.WithAttributes(attribute.String("watchdog.key", key)))
+	return span
+}
+
+// endSpan ends a span started by startSpan, marking it failed if err is set.
+func endSpan(span trace.Span, err error, attrs ...attribute.KeyValue) {
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.SetAttributes(attrs...)
+	span.End()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"time"
+)
+
+// maxBuckets bounds the number of per-key rate limiters, so that the
+// limiter itself can't be used to exhaust memory.
+const maxBuckets = 10000
+
+// bucket is a token bucket refilled at rate tokens per second up to burst.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
+
+// allowCheckin reports whether another checkin of key is allowed right now.
+func (s *Server) allowCheckin(key string, now time.Time) bool {
+	st := s.settings()
+	if st.checkinRate <= 0 {
+		return true
+	}
+	s.bucketsMu.Lock()
+	defer s.bucketsMu.Unlock()
+	b := s.buckets[key]
+	if b == nil {
+		if len(s.buckets) >= maxBuckets {
+			s.pruneBuckets(now, st)
+		}
+		b = &bucket{tokens: float64(st.checkinBurst), last: now}
+		s.buckets[key] = b
+	} else {
+		b.refill(now, st.checkinRate, st.checkinBurst)
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// pruneBuckets drops the buckets that have refilled completely, since they
+// are no different from new ones. If that's not enough, it also drops the
+// longest idle tenth of them, which are the closest to being full, so a
+// flood of new keys can't reset the limits of the busy ones. Must be called
+// with bucketsMu held.
+func (s *Server) pruneBuckets(now time.Time, st *settings) {
+	for key, b := range s.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*st.checkinRate >= float64(st.checkinBurst) {
+			delete(s.buckets, key)
+		}
+	}
+	if len(s.buckets) < maxBuckets {
+		return
+	}
+	keys := slices.SortedFunc(maps.Keys(s.buckets), func(a, b string) int {
+		return s.buckets[a].last.Compare(s.buckets[b].last)
+	})
+	for _, key := range keys[:maxBuckets/10] {
+		delete(s.buckets, key)
+	}
+}
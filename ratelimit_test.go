@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPruneBucketsKeepsBusyKeys(t *testing.T) {
+	s := testServer()
+	st := defaultSettings()
+	st.checkinRate = 1.0 / 60
+	st.checkinBurst = 2
+	s.current.Store(st)
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := range maxBuckets - 1 {
+		s.allowCheckin(fmt.Sprintf("flood%d-1h", i), start)
+	}
+	busy := start.Add(time.Second)
+	for s.allowCheckin("busy-1h", busy) {
+	}
+	for i := range maxBuckets {
+		s.allowCheckin(fmt.Sprintf("more%d-1h", i), busy)
+	}
+	if len(s.buckets) > maxBuckets {
+		t.Errorf("got %d buckets, want at most %d", len(s.buckets), maxBuckets)
+	}
+	if s.allowCheckin("busy-1h", busy) {
+		t.Error("pruning the buckets reset the limit of a busy key")
+	}
+}
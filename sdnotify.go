@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state message to systemd over $NOTIFY_SOCKET. It does
+// nothing when not running under systemd.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdog pings the systemd watchdog at half of WatchdogSec=, if it is
+// enabled for this service, as long as the evaluator keeps ticking. If it
+// gets stuck, e.g. on mu, the pings stop and systemd restarts the service.
+func (s *Server) sdWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	for {
+		if s.evaluatorAlive(time.Now(), interval) {
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				logEvent(slog.LevelError, "sd_notify_failed", fmt.Sprintf("sd_notify: %v", err), "error", err)
+			}
+		} else {
+			logEvent(slog.LevelError, "evaluator_stuck", "the evaluator has stopped ticking, not pinging the systemd watchdog")
+		}
+		time.Sleep(interval)
+	}
+}
+
+// evaluatorAlive reports whether the evaluator has completed a tick within
+// the last interval, on top of the check interval it ticks at.
+func (s *Server) evaluatorAlive(now time.Time, interval time.Duration) bool {
+	last := s.evaluated.Load()
+	return last != 0 && now.Sub(time.Unix(0, last)) <= s.checkInterval+interval
+}
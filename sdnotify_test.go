@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvaluatorAlive(t *testing.T) {
+	s := newServer()
+	s.checkInterval = 10 * time.Second
+	start := time.Now()
+	if s.evaluatorAlive(start, 15*time.Second) {
+		t.Error("alive before the evaluator started")
+	}
+	s.evaluated.Store(start.UnixNano())
+	for d, want := range map[time.Duration]bool{
+		time.Second:      true,
+		25 * time.Second: true,
+		26 * time.Second: false, // stuck for longer than a ping interval
+	} {
+		if got := s.evaluatorAlive(start.Add(d), 15*time.Second); got != want {
+			t.Errorf("alive %v after a tick = %v, want %v", d, got, want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"time"
+)
+
+const defaultSLAWindow = 7 * 24 * time.Hour
+
+type slaResponse struct {
+	Key              string    `json:"key"`
+	WindowSeconds    int64     `json:"window_seconds"`
+	From             time.Time `json:"from"` // where the measured span starts, see sla
+	ExpectedCheckins int64     `json:"expected_checkins"`
+	MissedCheckins   int64     `json:"missed_checkins"`
+	UptimePercent    *float64  `json:"uptime_percent"`      // null until a whole interval has passed
+	Truncated        bool      `json:"truncated,omitempty"` // the history doesn't reach back far enough, see -history
+}
+
+// slaHandler estimates how reliably a key checked in during ?window=
+// (a week by default), e.g. GET /backups-24h/sla?window=30d.
+func (s *Server) slaHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	lim, ok := s.limits(key)
+	if !ok {
+		httpError(w, errInvalidKey)
+		return
+	}
+	if lim.inverse {
+		http.Error(w, "Inverse keys have no SLA", http.StatusBadRequest)
+		return
+	}
+	window := defaultSLAWindow
+	if v := r.URL.Query().Get("window"); v != "" {
+		if window, ok = parseInterval(v); !ok {
+			http.Error(w, "Invalid window, must be like 168h or 7d", http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.mu.RLock()
+	h := slices.Clone(s.history[key])
+	s.mu.RUnlock()
+
+	writeJSON(w, s.sla(key, lim, h, window, now()))
+}
+
+// sla measures the span since the start of the window, or since the first
+// checkin in the history if that's later, in intervals of the key's alarm
+// threshold plus grace. An interval is missed when no successful checkin
+// happened within it, so that a gap of N intervals between two checkins, or
+// since the last one, misses N-1 or N checkins, respectively.
+func (s *Server) sla(key string, lim limits, h []time.Time, window time.Duration, now time.Time) *slaResponse {
+	resp := &slaResponse{Key: key, WindowSeconds: int64(window.Seconds()), From: now.Add(-window).UTC()}
+	interval := lim.alarm + lim.grace
+	if len(h) == 0 || interval <= 0 {
+		return resp
+	}
+	if h[0].After(resp.From) {
+		resp.Truncated = len(h) >= s.historySize
+		resp.From = h[0]
+	}
+	resp.ExpectedCheckins = int64(now.Sub(resp.From) / interval)
+	prev := resp.From
+	for _, t := range h {
+		if t.After(prev) {
+			// a checkin right at the deadline is still on time
+			resp.MissedCheckins += int64((t.Sub(prev) - 1) / interval)
+			prev = t
+		}
+	}
+	resp.MissedCheckins += int64(now.Sub(prev) / interval)
+	resp.MissedCheckins = min(resp.MissedCheckins, resp.ExpectedCheckins)
+	if resp.ExpectedCheckins > 0 {
+		pct := 100 * float64(resp.ExpectedCheckins-resp.MissedCheckins) / float64(resp.ExpectedCheckins)
+		resp.UptimePercent = &pct
+	}
+	return resp
+}
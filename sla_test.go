@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSLA(t *testing.T) {
+	s := newServer()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := []time.Time{start, start.Add(time.Hour), start.Add(4 * time.Hour)}
+	resp := s.sla("job-1h", limits{alarm: time.Hour}, h, 24*time.Hour, start.Add(4*time.Hour+30*time.Minute))
+	// 4 intervals since the first checkin, 2 missed between 1h and 4h
+	if resp.ExpectedCheckins != 4 || resp.MissedCheckins != 2 || resp.UptimePercent == nil || *resp.UptimePercent != 50 {
+		t.Errorf("sla = %+v, want 4 expected, 2 missed, 50%%", resp)
+	}
+
+	// zero intervals can't be parsed, but mustn't crash if they get here
+	resp = s.sla("job-0s", limits{}, h, 24*time.Hour, start.Add(5*time.Hour))
+	if resp.ExpectedCheckins != 0 || resp.UptimePercent != nil {
+		t.Errorf("sla of a zero interval = %+v, want nothing expected", resp)
+	}
+}
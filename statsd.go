@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// statsdMaxPacket keeps the datagrams under the usual network MTU.
+const statsdMaxPacket = 1432
+
+// statsdTagEscaper replaces the characters that delimit DogStatsD tags.
+var statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// statsdClient sends gauges over UDP in the DogStatsD format. Sending is
+// fire-and-forget, lost datagrams and errors are ignored.
+type statsdClient struct {
+	addr string
+	conn net.Conn
+}
+
+func newStatsd(addr string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -statsd %q: %w", addr, err)
+	}
+	return &statsdClient{addr: addr, conn: conn}, nil
+}
+
+func (c *statsdClient) String() string {
+	return c.addr
+}
+
+// send writes the lines, packing as many into a datagram as fit.
+func (c *statsdClient) send(lines []string) {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > statsdMaxPacket {
+			c.conn.Write(buf.Bytes())
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		c.conn.Write(buf.Bytes())
+	}
+}
+
+// statsdEmitter sends the metrics to StatsD every statsdInterval.
+func (s *Server) statsdEmitter() {
+	ticker := time.NewTicker(s.statsdInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		statuses := s.metricStatuses()
+		lines := make([]string, 0, len(statuses)+2)
+		alarming := 0
+		for _, st := range statuses {
+			if !isUp(st.Status) {
+				alarming++
+			}
+			lines = append(lines, fmt.Sprintf("watchdog.seconds_since_checkin:%.3f|g|#key:%s", st.since.Seconds(), statsdTagEscaper.Replace(st.Key)))
+		}
+		lines = append(lines, fmt.Sprintf("watchdog.keys:%d|g", len(statuses)), fmt.Sprintf("watchdog.alarming_keys:%d|g", alarming))
+		s.statsd.send(lines)
+	}
+}
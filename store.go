@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Store persists the database. Handlers never talk to a Store directly; the
+// in-memory maps are loaded at startup and saved through saver.
+type Store interface {
+	Load() (*database, error)
+	Save(db *database) error
+}
+
+// incrementalStore is implemented by stores that can save individual keys
+// instead of rewriting the whole database. SaveKeys receives the current
+// data of the given keys; keys missing from db.Checkins have been deleted.
+type incrementalStore interface {
+	Store
+	SaveKeys(db *database, keys []string) error
+}
+
+// sharedStore is implemented by stores that several servers can use at
+// the same time. Servers reload them periodically to see each other's
+// checkins.
+type sharedStore interface {
+	Store
+	shared()
+}
+
+// openStore opens a store given a -db spec like sqlite:watchdog.db.
+func openStore(spec string) (Store, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "sqlite":
+		return openSQLiteStore(arg)
+	case "redis", "rediss":
+		return openRedisStore(spec)
+	case "postgres", "postgresql":
+		return openPostgresStore(spec)
+	default:
+		return nil, fmt.Errorf("unsupported database %q", spec)
+	}
+}
+
+// errCorrupted is returned by Store.Load when the stored data can't be parsed.
+var errCorrupted = errors.New("corrupted database")
+
+// errStoreUnavailable is returned by stores that can't reach their server.
+// Saves are then retried, and the server keeps running on its in-memory
+// data meanwhile.
+var errStoreUnavailable = errors.New("database unavailable")
+
+// dbVersion is the current version of the database format. Version 1 was
+// a bare checkins map, which jsonFileStore still accepts.
+const dbVersion = 2
+
+// database is the persisted state.
+type database struct {
+	Version    int                    `json:"version"`
+	Checkins   map[string]time.Time   `json:"checkins"`
+	States     map[string]string      `json:"states,omitempty"`
+	AlarmSince map[string]time.Time   `json:"alarm_since,omitempty"`
+	StateSince map[string]time.Time   `json:"state_since,omitempty"`
+	Acks       map[string]time.Time   `json:"acked_until,omitempty"`
+	History    map[string][]time.Time `json:"history,omitempty"`
+	Sources    map[string]string      `json:"sources,omitempty"`
+	Notes      map[string]string      `json:"notes,omitempty"`
+	Starts     map[string]time.Time   `json:"started_at,omitempty"`
+	Failures   map[string]time.Time   `json:"failed_at,omitempty"`
+	Intervals  map[string]string      `json:"intervals,omitempty"`
+}
+
+// jsonFileStore keeps the whole database in a single JSON file.
+type jsonFileStore struct {
+	filename string
+	fsync    bool
+}
+
+// Load reads the database, rewriting files of older versions in the current
+// format. After a successful load, the file is copied to a .bak file, which
+// is loaded instead if the file turns out corrupted the next time. The
+// corrupted file is moved aside rather than overwritten by the next save.
+func (s *jsonFileStore) Load() (*database, error) {
+	data, err := os.ReadFile(s.filename)
+	if err != nil {
+		return nil, err
+	}
+	db, err := decodeDatabase(data, s.filename)
+	if err == nil {
+		if err := writeFileAtomic(s.backupName(), data, 0644, s.fsync); err != nil {
+			log.Printf("warning: cannot keep a copy of the watchdogd database: %v", err)
+		}
+		if db.Version < dbVersion {
+			// the .bak keeps the old format in case of a downgrade
+			old := db.Version
+			db.Version = dbVersion
+			if err := s.Save(db); err != nil {
+				return nil, fmt.Errorf("upgrading %s from version %d: %w", s.filename, old, err)
+			}
+			log.Printf("upgraded %s from version %d to %d.", s.filename, old, dbVersion)
+		}
+		return db, nil
+	} else if !errors.Is(err, errCorrupted) {
+		return nil, err
+	}
+
+	aside := fmt.Sprintf("%s.corrupt-%s", s.filename, now().UTC().Format("20060102-150405"))
+	if err := os.Rename(s.filename, aside); err != nil {
+		return nil, fmt.Errorf("%s is corrupted and cannot be moved aside: %w", s.filename, err)
+	}
+	log.Printf("%s is corrupted, moved it to %s.", s.filename, aside)
+	data, err = os.ReadFile(s.backupName())
+	if err == nil {
+		db, err = decodeDatabase(data, s.backupName())
+	}
+	if err != nil {
+		log.Printf("cannot load %s either: %v", s.backupName(), err)
+		return nil, errCorrupted
+	}
+	log.Printf("loaded %s instead, losing the checkins since the last start.", s.backupName())
+	return db, nil
+}
+
+func (s *jsonFileStore) backupName() string {
+	return s.filename + ".bak"
+}
+
+// decodeDatabase parses the JSON database format, returning errors that
+// mention name.
+func decodeDatabase(data []byte, name string) (*database, error) {
+	var db database
+	err := json.Unmarshal(data, &db)
+	if err == nil && db.Checkins == nil {
+		db.Version = 1
+		err = json.Unmarshal(data, &db.Checkins)
+	}
+	if err != nil {
+		return nil, errCorrupted
+	}
+	if db.Version > dbVersion {
+		return nil, fmt.Errorf("%s has version %d, only versions up to %d are supported", name, db.Version, dbVersion)
+	}
+	return &db, nil
+}
+
+func (s *jsonFileStore) Save(db *database) error {
+	data := must(json.MarshalIndent(db, "", "  "))
+	return writeFileAtomic(s.filename, data, 0644, s.fsync)
+}
+
+// writeFileAtomic writes data into a temporary file next to fn and renames it
+// into place, so that a crash never leaves a truncated file behind.
+func writeFileAtomic(fn string, data []byte, perm os.FileMode, fsync bool) error {
+	f, err := os.CreateTemp(filepath.Dir(fn), filepath.Base(fn)+".tmp.*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // fails harmlessly after a successful rename
+
+	_, err = f.Write(data)
+	if err == nil && fsync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, fn)
+	if err != nil {
+		return err
+	}
+	if fsync {
+		if d, err := os.Open(filepath.Dir(fn)); err == nil {
+			d.Sync()
+			d.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// postgresMigrations create and upgrade the schema. Each one is applied
+// once, in order; change the schema by appending new ones.
+var postgresMigrations = []string{
+	`CREATE TABLE watchdog_keys (
+		key TEXT PRIMARY KEY,
+		last_checkin TIMESTAMPTZ NOT NULL,
+		history JSONB, -- recent checkins, oldest first
+		source TEXT,   -- address of the last checkin
+		note TEXT,
+		state TEXT,
+		alarm_since TIMESTAMPTZ, -- NULL unless in ALARM
+		acked_until TIMESTAMPTZ
+	)`,
+	// every checkin seen, for reporting; kept for -event-retention
+	`CREATE TABLE checkin_events (
+		key TEXT NOT NULL,
+		checked_in_at TIMESTAMPTZ NOT NULL,
+		source TEXT,
+		note TEXT,
+		PRIMARY KEY (key, checked_in_at)
+	)`,
+	`ALTER TABLE watchdog_keys
+		ADD COLUMN started_at TIMESTAMPTZ, -- NULL unless a run is in progress
+		ADD COLUMN failed_at TIMESTAMPTZ   -- NULL unless the last run failed
+	`,
+	`ALTER TABLE checkin_events ADD COLUMN kind TEXT NOT NULL DEFAULT 'success'`,
+	// set with /{key}/config, possibly before the first checkin
+	`CREATE TABLE watchdog_intervals (
+		key TEXT PRIMARY KEY,
+		spec TEXT NOT NULL -- like 45s or 30m-1h
+	)`,
+	`ALTER TABLE watchdog_keys ADD COLUMN state_since TIMESTAMPTZ`, // NULL if unknown
+}
+
+// postgresMigrationLock is the advisory lock that keeps several servers
+// from migrating the schema at the same time.
+const postgresMigrationLock = 0x77617463 // "watc"
+
+// postgresStore keeps one row per key, like sqliteStore, and additionally
+// logs all checkins into checkin_events.
+type postgresStore struct {
+	db        *sql.DB
+	retention time.Duration // of checkin_events, 0 keeps them forever
+}
+
+func openPostgresStore(dsn string) (*postgresStore, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: %w", err)
+	}
+	// Saves are serialized, so one connection does the writing, and another
+	// one is enough for the occasional load.
+	db.SetMaxOpenConns(2)
+	db.SetMaxIdleConns(2)
+	db.SetConnMaxIdleTime(5 * time.Minute)
+	if err := migratePostgres(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("postgres: migrating schema: %w", err)
+	}
+	return &postgresStore{db: db}, nil
+}
+
+func migratePostgres(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, postgresMigrationLock); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS watchdog_schema (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	var version int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM watchdog_schema`).Scan(&version); err != nil {
+		return err
+	}
+	if version > len(postgresMigrations) {
+		return fmt.Errorf("database has schema version %d, only versions up to %d are supported", version, len(postgresMigrations))
+	}
+	for i := version; i < len(postgresMigrations); i++ {
+		if _, err := tx.Exec(postgresMigrations[i]); err != nil {
+			return fmt.Errorf("version %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO watchdog_schema (version) VALUES ($1)`, i+1); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) Load() (*database, error) {
+	db := &database{
+		Version:    dbVersion,
+		Checkins:   make(map[string]time.Time),
+		States:     make(map[string]string),
+		AlarmSince: make(map[string]time.Time),
+		StateSince: make(map[string]time.Time),
+		Acks:       make(map[string]time.Time),
+		History:    make(map[string][]time.Time),
+		Sources:    make(map[string]string),
+		Notes:      make(map[string]string),
+		Starts:     make(map[string]time.Time),
+		Failures:   make(map[string]time.Time),
+		Intervals:  make(map[string]string),
+	}
+
+	rows, err := s.db.Query(`SELECT key, last_checkin, history::text, source, note, started_at, failed_at, state, alarm_since, state_since, acked_until FROM watchdog_keys`)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var t time.Time
+		var history, source, note, state sql.NullString
+		var started, failed, since, stateSince, until sql.NullTime
+		if err := rows.Scan(&key, &t, &history, &source, &note, &started, &failed, &state, &since, &stateSince, &until); err != nil {
+			return nil, err
+		}
+		db.Checkins[key] = t
+		if history.Valid {
+			var h []time.Time
+			if json.Unmarshal([]byte(history.String), &h) != nil {
+				return nil, errCorrupted
+			}
+			db.History[key] = h
+		}
+		if source.Valid {
+			db.Sources[key] = source.String
+		}
+		if note.Valid {
+			db.Notes[key] = note.String
+		}
+		if started.Valid {
+			db.Starts[key] = started.Time
+		}
+		if failed.Valid {
+			db.Failures[key] = failed.Time
+		}
+		if state.Valid {
+			db.States[key] = state.String
+		}
+		if since.Valid {
+			db.AlarmSince[key] = since.Time
+		}
+		if stateSince.Valid {
+			db.StateSince[key] = stateSince.Time
+		}
+		if until.Valid {
+			db.Acks[key] = until.Time
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, postgresError(err)
+	}
+
+	rows, err = s.db.Query(`SELECT key, spec FROM watchdog_intervals`)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, spec string
+		if err := rows.Scan(&key, &spec); err != nil {
+			return nil, err
+		}
+		db.Intervals[key] = spec
+	}
+	if err := rows.Err(); err != nil {
+		return nil, postgresError(err)
+	}
+
+	if len(db.Checkins) == 0 && len(db.Intervals) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return db, nil
+}
+
+func (s *postgresStore) Save(db *database) error {
+	return postgresError(s.write(db, nil, true))
+}
+
+func (s *postgresStore) SaveKeys(db *database, keys []string) error {
+	return postgresError(s.write(db, keys, false))
+}
+
+func (s *postgresStore) write(db *database, keys []string, replace bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if replace {
+		if _, err := tx.Exec(`DELETE FROM watchdog_keys`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM watchdog_intervals`); err != nil {
+			return err
+		}
+		for key := range db.Checkins {
+			keys = append(keys, key)
+		}
+		for key := range db.Intervals {
+			if _, ok := db.Checkins[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	for _, key := range keys {
+		if spec, ok := db.Intervals[key]; ok {
+			_, err = tx.Exec(`INSERT INTO watchdog_intervals (key, spec) VALUES ($1, $2)
+				ON CONFLICT (key) DO UPDATE SET spec = excluded.spec`, key, spec)
+		} else {
+			_, err = tx.Exec(`DELETE FROM watchdog_intervals WHERE key = $1`, key)
+		}
+		if err != nil {
+			return err
+		}
+		t, ok := db.Checkins[key]
+		if !ok {
+			if _, err := tx.Exec(`DELETE FROM watchdog_keys WHERE key = $1`, key); err != nil {
+				return err
+			}
+			continue
+		}
+		var prev sql.NullTime
+		err = tx.QueryRow(`SELECT last_checkin FROM watchdog_keys WHERE key = $1`, key).Scan(&prev)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		var history any
+		if h, ok := db.History[key]; ok {
+			history = string(must(json.Marshal(h)))
+		}
+		source, note := nullable(db.Sources, key), nullable(db.Notes, key)
+		started, failed := nullable(db.Starts, key), nullable(db.Failures, key)
+		_, err := tx.Exec(`INSERT INTO watchdog_keys (key, last_checkin, history, source, note, started_at, failed_at, state, alarm_since, state_since, acked_until)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			ON CONFLICT (key) DO UPDATE SET last_checkin = excluded.last_checkin, history = excluded.history,
+				source = excluded.source, note = excluded.note, started_at = excluded.started_at, failed_at = excluded.failed_at,
+				state = excluded.state, alarm_since = excluded.alarm_since, state_since = excluded.state_since, acked_until = excluded.acked_until`,
+			key, t, history, source, note, started, failed, nullable(db.States, key), nullable(db.AlarmSince, key), nullable(db.StateSince, key), nullable(db.Acks, key))
+		if err != nil {
+			return err
+		}
+
+		// The source and the note are only known for the last checkin. Older
+		// ones in the history have been logged by previous saves, except for
+		// those since the last_checkin then when several checkins happened
+		// between two saves.
+		kind := checkinSuccess
+		if db.Failures[key].Equal(t) {
+			kind = checkinFail
+		} else if db.Starts[key].Equal(t) {
+			kind = checkinStart
+		}
+		_, err = tx.Exec(`INSERT INTO checkin_events (key, checked_in_at, kind, source, note) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT DO NOTHING`, key, t, kind, source, note)
+		if err != nil {
+			return err
+		}
+		for _, t := range db.History[key] {
+			if prev.Valid && !t.After(prev.Time) {
+				continue
+			}
+			_, err = tx.Exec(`INSERT INTO checkin_events (key, checked_in_at) VALUES ($1, $2)
+				ON CONFLICT DO NOTHING`, key, t)
+			if err != nil {
+				return err
+			}
+		}
+		if s.retention > 0 {
+			_, err = tx.Exec(`DELETE FROM checkin_events WHERE key = $1 AND checked_in_at < $2`, key, now().Add(-s.retention))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// nullable returns m[key], or nil (NULL) if there's no such key.
+func nullable[T any](m map[string]T, key string) any {
+	if v, ok := m[key]; ok {
+		return v
+	}
+	return nil
+}
+
+// postgresError marks the errors that don't come from the Postgres server
+// itself, like connection failures, as errStoreUnavailable.
+func postgresError(err error) error {
+	var pgerr *pgconn.PgError
+	if err == nil || errors.Is(err, errCorrupted) || errors.As(err, &pgerr) {
+		return err
+	}
+	return fmt.Errorf("postgres: %w: %w", errStoreUnavailable, err)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisTimeout = 5 * time.Second
+
+// redisHashes hold one field per key. The first six describe the last
+// checkin and are only written together, see redisSaveKey.
+var redisHashes = []string{
+	"watchdog:checkins",    // Unix nanoseconds
+	"watchdog:history",     // JSON array of timestamps, oldest first
+	"watchdog:sources",     // address of the last checkin
+	"watchdog:notes",       // note sent with the last checkin
+	"watchdog:started_at",  // Unix nanoseconds, unset unless a run is in progress
+	"watchdog:failed_at",   // Unix nanoseconds, unset unless the last run failed
+	"watchdog:states",      // last reported status
+	"watchdog:alarm_since", // Unix nanoseconds, unset unless in ALARM
+	"watchdog:acks",        // Unix nanoseconds
+	"watchdog:state_since", // Unix nanoseconds, unset if unknown
+}
+
+// redisIntervals holds the limits set with /{key}/config. It's kept apart
+// from redisHashes, since keys can be configured before their first checkin.
+const redisIntervals = "watchdog:intervals"
+
+// redisSaveKey saves one key. ARGV[1] is the key and ARGV[2..] are its
+// values in redisHashes order, an empty value deleting the field. When
+// another server has already stored a later checkin, the checkin fields are
+// left alone. Timestamps all have the same number of digits, so they can be
+// compared as strings.
+var redisSaveKey = redis.NewScript(`
+local cur = redis.call('HGET', KEYS[1], ARGV[1])
+local stale = cur and cur > ARGV[2]
+for i, hash in ipairs(KEYS) do
+	if i > 6 or not stale then
+		local v = ARGV[i + 1]
+		if v == '' then
+			redis.call('HDEL', hash, ARGV[1])
+		else
+			redis.call('HSET', hash, ARGV[1], v)
+		end
+	end
+end
+return 1
+`)
+
+// redisStore keeps the database in Redis hashes, so that several servers
+// can share it. Every key is saved separately, and servers reload the hashes
+// periodically to see each other's checkins.
+type redisStore struct {
+	client *redis.Client
+}
+
+func openRedisStore(url string) (*redisStore, error) {
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	// Redis being down at startup is not an error, the server starts empty
+	// and picks up the data once it's back.
+	return &redisStore{client: redis.NewClient(opt)}, nil
+}
+
+func (s *redisStore) shared() {}
+
+func (s *redisStore) Load() (*database, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	cmds := make([]*redis.MapStringStringCmd, len(redisHashes)+1)
+	_, err := s.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, hash := range append(redisHashes, redisIntervals) {
+			cmds[i] = p.HGetAll(ctx, hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, redisError(err)
+	}
+	val := func(i int) map[string]string { return cmds[i].Val() }
+	checkins, history, sources, notes, starts, failures, states, alarmSince, acks, stateSince := val(0), val(1), val(2), val(3), val(4), val(5), val(6), val(7), val(8), val(9)
+
+	db := &database{
+		Version:    dbVersion,
+		Checkins:   make(map[string]time.Time),
+		States:     states,
+		AlarmSince: make(map[string]time.Time),
+		StateSince: make(map[string]time.Time),
+		Acks:       make(map[string]time.Time),
+		History:    make(map[string][]time.Time),
+		Sources:    sources,
+		Notes:      notes,
+		Starts:     make(map[string]time.Time),
+		Failures:   make(map[string]time.Time),
+		Intervals:  val(len(redisHashes)),
+	}
+	for _, m := range []struct {
+		values map[string]string
+		times  map[string]time.Time
+	}{{checkins, db.Checkins}, {starts, db.Starts}, {failures, db.Failures}, {alarmSince, db.AlarmSince}, {stateSince, db.StateSince}, {acks, db.Acks}} {
+		for key, v := range m.values {
+			ns, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, errCorrupted
+			}
+			m.times[key] = time.Unix(0, ns).UTC()
+		}
+	}
+	for key, v := range history {
+		var h []time.Time
+		if json.Unmarshal([]byte(v), &h) != nil {
+			return nil, errCorrupted
+		}
+		db.History[key] = h
+	}
+
+	if len(db.Checkins) == 0 && len(db.Intervals) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return db, nil
+}
+
+func (s *redisStore) Save(db *database) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	_, err := s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Del(ctx, append(redisHashes, redisIntervals)...)
+		for key := range db.Checkins {
+			saveRedisKey(ctx, p, db, key)
+		}
+		for key, spec := range db.Intervals {
+			p.HSet(ctx, redisIntervals, key, spec)
+		}
+		return nil
+	})
+	return redisError(err)
+}
+
+func (s *redisStore) SaveKeys(db *database, keys []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	_, err := s.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, key := range keys {
+			if spec, ok := db.Intervals[key]; ok {
+				p.HSet(ctx, redisIntervals, key, spec)
+			} else {
+				p.HDel(ctx, redisIntervals, key)
+			}
+			if _, ok := db.Checkins[key]; ok {
+				saveRedisKey(ctx, p, db, key)
+			} else {
+				for _, hash := range redisHashes {
+					p.HDel(ctx, hash, key)
+				}
+			}
+		}
+		return nil
+	})
+	return redisError(err)
+}
+
+func saveRedisKey(ctx context.Context, p redis.Pipeliner, db *database, key string) {
+	unixNano := func(t time.Time, ok bool) string {
+		if !ok {
+			return ""
+		}
+		return strconv.FormatInt(t.UnixNano(), 10)
+	}
+	var history string
+	if h, ok := db.History[key]; ok {
+		history = string(must(json.Marshal(h)))
+	}
+	checkin, ok := db.Checkins[key]
+	started, startedOK := db.Starts[key]
+	failed, failedOK := db.Failures[key]
+	since, sinceOK := db.AlarmSince[key]
+	until, untilOK := db.Acks[key]
+	stateSince, stateSinceOK := db.StateSince[key]
+	redisSaveKey.Eval(ctx, p, redisHashes, key,
+		unixNano(checkin, ok), history, db.Sources[key], db.Notes[key], unixNano(started, startedOK), unixNano(failed, failedOK),
+		db.States[key], unixNano(since, sinceOK), unixNano(until, untilOK), unixNano(stateSince, stateSinceOK))
+}
+
+// redisError marks the errors that don't come from Redis itself, like
+// connection failures, as errStoreUnavailable.
+func redisError(err error) error {
+	var rerr redis.Error
+	if err == nil || errors.As(err, &rerr) {
+		return err
+	}
+	return fmt.Errorf("redis: %w: %w", errStoreUnavailable, err)
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS checkins (
+	key TEXT PRIMARY KEY,
+	last_checkin INTEGER NOT NULL -- Unix nanoseconds
+);
+CREATE TABLE IF NOT EXISTS states (
+	key TEXT PRIMARY KEY,
+	state TEXT NOT NULL,
+	alarm_since INTEGER -- Unix nanoseconds, NULL unless in ALARM
+);
+CREATE TABLE IF NOT EXISTS acks (
+	key TEXT PRIMARY KEY,
+	acked_until INTEGER NOT NULL -- Unix nanoseconds
+);
+CREATE TABLE IF NOT EXISTS history (
+	key TEXT PRIMARY KEY,
+	checkins TEXT NOT NULL -- JSON array of timestamps, oldest first
+);
+CREATE TABLE IF NOT EXISTS sources (
+	key TEXT PRIMARY KEY,
+	addr TEXT NOT NULL -- address of the last checkin
+);
+CREATE TABLE IF NOT EXISTS notes (
+	key TEXT PRIMARY KEY,
+	note TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS runs (
+	key TEXT PRIMARY KEY,
+	started_at INTEGER, -- Unix nanoseconds, NULL unless a run is in progress
+	failed_at INTEGER   -- Unix nanoseconds, NULL unless the last run failed
+);
+CREATE TABLE IF NOT EXISTS intervals (
+	key TEXT PRIMARY KEY,
+	spec TEXT NOT NULL -- like 45s or 30m-1h, set with /{key}/config
+);
+`
+
+// sqliteTables hold the data of the keys that have checked in. Intervals
+// are kept separately, since they can be configured before the first checkin.
+var sqliteTables = []string{"checkins", "states", "acks", "history", "sources", "notes", "runs"}
+
+// sqliteStore keeps one row per key, so saves only touch the keys that
+// have changed.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(fn string) (*sqliteStore, error) {
+	if fn == "" {
+		return nil, errors.New("sqlite: missing database file name")
+	}
+	db, err := sql.Open("sqlite", fn)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: %w", err)
+	}
+	// A single connection serializes all writes, so concurrent saves never
+	// run into SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	for _, pragma := range []string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000"} {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("sqlite: %s: %w", pragma, err)
+		}
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite: creating schema: %w", err)
+	}
+	if err := addSQLiteColumn(db, "states", "state_since INTEGER"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite: upgrading schema: %w", err)
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+// addSQLiteColumn adds a column to a table created before the column was
+// added to sqliteSchema.
+func addSQLiteColumn(db *sql.DB, table, column string) error {
+	name, _, _ := strings.Cut(column, " ")
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, name).Scan(&n); err != nil || n > 0 {
+		return err
+	}
+	_, err := db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column)
+	return err
+}
+
+func (s *sqliteStore) Load() (*database, error) {
+	db := &database{
+		Checkins:   make(map[string]time.Time),
+		States:     make(map[string]string),
+		AlarmSince: make(map[string]time.Time),
+		StateSince: make(map[string]time.Time),
+		Acks:       make(map[string]time.Time),
+		History:    make(map[string][]time.Time),
+		Sources:    make(map[string]string),
+		Notes:      make(map[string]string),
+		Starts:     make(map[string]time.Time),
+		Failures:   make(map[string]time.Time),
+		Intervals:  make(map[string]string),
+	}
+
+	rows, err := s.db.Query(`SELECT key, last_checkin FROM checkins`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var t int64
+		if err := rows.Scan(&key, &t); err != nil {
+			return nil, err
+		}
+		db.Checkins[key] = time.Unix(0, t).UTC()
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(`SELECT key, state, alarm_since, state_since FROM states`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, state string
+		var since, stateSince sql.NullInt64
+		if err := rows.Scan(&key, &state, &since, &stateSince); err != nil {
+			return nil, err
+		}
+		db.States[key] = state
+		if since.Valid {
+			db.AlarmSince[key] = time.Unix(0, since.Int64).UTC()
+		}
+		if stateSince.Valid {
+			db.StateSince[key] = time.Unix(0, stateSince.Int64).UTC()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(`SELECT key, acked_until FROM acks`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var t int64
+		if err := rows.Scan(&key, &t); err != nil {
+			return nil, err
+		}
+		db.Acks[key] = time.Unix(0, t).UTC()
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(`SELECT key, checkins FROM history`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var data []byte
+		if err := rows.Scan(&key, &data); err != nil {
+			return nil, err
+		}
+		var h []time.Time
+		if err := json.Unmarshal(data, &h); err != nil {
+			return nil, fmt.Errorf("history of %s: %w", key, errCorrupted)
+		}
+		db.History[key] = h
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(`SELECT key, addr FROM sources`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, addr string
+		if err := rows.Scan(&key, &addr); err != nil {
+			return nil, err
+		}
+		db.Sources[key] = addr
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(`SELECT key, note FROM notes`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, note string
+		if err := rows.Scan(&key, &note); err != nil {
+			return nil, err
+		}
+		db.Notes[key] = note
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(`SELECT key, started_at, failed_at FROM runs`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var started, failed sql.NullInt64
+		if err := rows.Scan(&key, &started, &failed); err != nil {
+			return nil, err
+		}
+		if started.Valid {
+			db.Starts[key] = time.Unix(0, started.Int64).UTC()
+		}
+		if failed.Valid {
+			db.Failures[key] = time.Unix(0, failed.Int64).UTC()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(`SELECT key, spec FROM intervals`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, spec string
+		if err := rows.Scan(&key, &spec); err != nil {
+			return nil, err
+		}
+		db.Intervals[key] = spec
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(db.Checkins) == 0 && len(db.Intervals) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return db, nil
+}
+
+func (s *sqliteStore) Save(db *database) error {
+	return s.write(db, nil, true)
+}
+
+func (s *sqliteStore) SaveKeys(db *database, keys []string) error {
+	return s.write(db, keys, false)
+}
+
+func (s *sqliteStore) write(db *database, keys []string, replace bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if replace {
+		for _, table := range append(sqliteTables, "intervals") {
+			if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+				return err
+			}
+		}
+		for key := range db.Checkins {
+			keys = append(keys, key)
+		}
+		for key := range db.Intervals {
+			if _, ok := db.Checkins[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	for _, key := range keys {
+		if spec, ok := db.Intervals[key]; ok {
+			_, err = tx.Exec(`INSERT INTO intervals (key, spec) VALUES (?, ?)
+				ON CONFLICT (key) DO UPDATE SET spec = excluded.spec`, key, spec)
+		} else {
+			_, err = tx.Exec(`DELETE FROM intervals WHERE key = ?`, key)
+		}
+		if err != nil {
+			return err
+		}
+		t, ok := db.Checkins[key]
+		if !ok {
+			for _, table := range sqliteTables {
+				if _, err := tx.Exec(`DELETE FROM `+table+` WHERE key = ?`, key); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		_, err := tx.Exec(`INSERT INTO checkins (key, last_checkin) VALUES (?, ?)
+			ON CONFLICT (key) DO UPDATE SET last_checkin = excluded.last_checkin`, key, t.UnixNano())
+		if err != nil {
+			return err
+		}
+		if state, ok := db.States[key]; ok {
+			since, sok := db.AlarmSince[key]
+			stateSince, ssok := db.StateSince[key]
+			_, err := tx.Exec(`INSERT INTO states (key, state, alarm_since, state_since) VALUES (?, ?, ?, ?)
+				ON CONFLICT (key) DO UPDATE SET state = excluded.state, alarm_since = excluded.alarm_since, state_since = excluded.state_since`,
+				key, state, sqliteTime(since, sok), sqliteTime(stateSince, ssok))
+			if err != nil {
+				return err
+			}
+		}
+		if until, ok := db.Acks[key]; ok {
+			_, err = tx.Exec(`INSERT INTO acks (key, acked_until) VALUES (?, ?)
+				ON CONFLICT (key) DO UPDATE SET acked_until = excluded.acked_until`, key, until.UnixNano())
+		} else {
+			_, err = tx.Exec(`DELETE FROM acks WHERE key = ?`, key)
+		}
+		if err != nil {
+			return err
+		}
+		if h, ok := db.History[key]; ok {
+			_, err = tx.Exec(`INSERT INTO history (key, checkins) VALUES (?, ?)
+				ON CONFLICT (key) DO UPDATE SET checkins = excluded.checkins`, key, string(must(json.Marshal(h))))
+		} else {
+			_, err = tx.Exec(`DELETE FROM history WHERE key = ?`, key)
+		}
+		if err != nil {
+			return err
+		}
+		if addr, ok := db.Sources[key]; ok {
+			_, err = tx.Exec(`INSERT INTO sources (key, addr) VALUES (?, ?)
+				ON CONFLICT (key) DO UPDATE SET addr = excluded.addr`, key, addr)
+		} else {
+			_, err = tx.Exec(`DELETE FROM sources WHERE key = ?`, key)
+		}
+		if err != nil {
+			return err
+		}
+		if note, ok := db.Notes[key]; ok {
+			_, err = tx.Exec(`INSERT INTO notes (key, note) VALUES (?, ?)
+				ON CONFLICT (key) DO UPDATE SET note = excluded.note`, key, note)
+		} else {
+			_, err = tx.Exec(`DELETE FROM notes WHERE key = ?`, key)
+		}
+		if err != nil {
+			return err
+		}
+		started, sok := db.Starts[key]
+		failed, fok := db.Failures[key]
+		if sok || fok {
+			_, err = tx.Exec(`INSERT INTO runs (key, started_at, failed_at) VALUES (?, ?, ?)
+				ON CONFLICT (key) DO UPDATE SET started_at = excluded.started_at, failed_at = excluded.failed_at`,
+				key, sqliteTime(started, sok), sqliteTime(failed, fok))
+		} else {
+			_, err = tx.Exec(`DELETE FROM runs WHERE key = ?`, key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// sqliteTime returns t in Unix nanoseconds, or NULL unless ok.
+func sqliteTime(t time.Time, ok bool) sql.NullInt64 {
+	return sql.NullInt64{Int64: t.UnixNano(), Valid: ok}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJSONFileStoreCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "watchdog.json")
+	store := &jsonFileStore{filename: fn}
+	checkin := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	setClock(t, checkin)
+
+	if err := store.Save(&database{Version: dbVersion, Checkins: map[string]time.Time{"job-1h": checkin}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); err != nil { // keeps the .bak
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as after a bad shutdown
+	if err := os.WriteFile(fn, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load of a truncated file = %v, want the .bak loaded", err)
+	}
+	if !db.Checkins["job-1h"].Equal(checkin) {
+		t.Errorf("loaded %v from the .bak, want job-1h at %v", db.Checkins, checkin)
+	}
+	aside := fn + ".corrupt-20260101-120000"
+	if got, err := os.ReadFile(aside); err != nil || string(got) != string(data[:len(data)/2]) {
+		t.Errorf("truncated file not moved to %s: %v", aside, err)
+	}
+	if _, err := os.Stat(fn); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("truncated file left in place: %v", err)
+	}
+
+	// both corrupted
+	if err := os.WriteFile(fn, []byte(`{"version": 2, "checkins": {`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(store.backupName(), []byte(`[`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); err != errCorrupted {
+		t.Errorf("Load with both files corrupted = %v, want %v", err, errCorrupted)
+	}
+}
+
+func TestSQLiteStoreRoundTrip(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "watchdog.db")
+	checkin := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	store, err := openSQLiteStore(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Load of a new database = %v, want %v", err, os.ErrNotExist)
+	}
+	db := &database{
+		Checkins:   map[string]time.Time{"a-1h": checkin, "b-1h": checkin, "c-1h": checkin},
+		States:     map[string]string{"a-1h": statusAlarm, "b-1h": statusOkay},
+		AlarmSince: map[string]time.Time{"a-1h": checkin.Add(time.Hour)},
+	}
+	if err := store.SaveKeys(db, []string{"a-1h", "b-1h", "c-1h"}); err != nil {
+		t.Fatal(err)
+	}
+	// a-1h recovers, c-1h is deleted
+	db.Checkins["a-1h"] = checkin.Add(2 * time.Hour)
+	db.States["a-1h"] = statusOkay
+	delete(db.AlarmSince, "a-1h")
+	delete(db.Checkins, "c-1h")
+	if err := store.SaveKeys(db, []string{"a-1h", "c-1h"}); err != nil {
+		t.Fatal(err)
+	}
+	store.db.Close()
+
+	// a restart
+	store, err = openSQLiteStore(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.db.Close()
+	got, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Checkins) != 2 || !got.Checkins["a-1h"].Equal(checkin.Add(2*time.Hour)) || !got.Checkins["b-1h"].Equal(checkin) {
+		t.Errorf("loaded checkins %v, want a-1h at %v and b-1h at %v", got.Checkins, checkin.Add(2*time.Hour), checkin)
+	}
+	if len(got.States) != 2 || got.States["a-1h"] != statusOkay || got.States["b-1h"] != statusOkay {
+		t.Errorf("loaded states %v, want a-1h and b-1h OKAY", got.States)
+	}
+	if len(got.AlarmSince) != 0 {
+		t.Errorf("loaded alarm_since %v, want none", got.AlarmSince)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the certificate from certFile and keyFile, reloading it
+// whenever either file changes, so that renewed certificates (e.g. from
+// Let's Encrypt) are picked up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t := c.latestModTime(); !t.IsZero() && !t.Equal(c.modTime) {
+		if err := c.reload(); err != nil {
+			log.Printf("reloading TLS certificate failed, still using the old one: %v", err)
+		} else {
+			log.Printf("reloaded TLS certificate from %s", c.certFile)
+		}
+	}
+	return c.cert, nil
+}
+
+// reload loads the certificate. Must be called with mu held (or before
+// the reloader is shared).
+func (c *certReloader) reload() error {
+	modTime := c.latestModTime()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modTime = &cert, modTime
+	return nil
+}
+
+func (c *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, fn := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return time.Time{}
+		}
+		if t := fi.ModTime(); t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time, e.g.:
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// buildVersion returns the version info from -ldflags, filling the gaps
+// from the info embedded by the Go toolchain.
+func buildVersion() *versionInfo {
+	v := &versionInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if v.Version == "" {
+			v.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && v.Commit == "":
+				v.Commit = s.Value
+			case s.Key == "vcs.time" && v.BuildDate == "":
+				v.BuildDate = s.Value
+			}
+		}
+	}
+	if v.Version == "" {
+		v.Version = "(devel)"
+	}
+	return v
+}
+
+func (v *versionInfo) String() string {
+	s := "watchdogd " + v.Version
+	if v.Commit != "" {
+		s += " commit " + v.Commit
+	}
+	if v.BuildDate != "" {
+		s += " built " + v.BuildDate
+	}
+	return s + " " + v.GoVersion
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	v := buildVersion()
+	if wantsJSON(r) {
+		writeJSON(w, v)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, v)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// maxPendingWebhooks bounds the number of webhook deliveries kept for
+// retrying while the receivers are failing.
+const maxPendingWebhooks = 1000
+
+// delivery is a webhook POST, retried with exponential backoff until it
+// succeeds or runs out of attempts. Only kept in memory.
+type delivery struct {
+	name     string // for the logs, since the URL often embeds a secret
+	url      string
+	secret   string // signs the requests, see postJSON
+	key      string
+	payload  any
+	attempts int
+	next     time.Time // of the next attempt
+}
+
+// postWebhook delivers payload to url, or queues it for a retry. Deliveries
+// to the same URL about the same key are done in order. Only called by the
+// notifier goroutine.
+func (s *Server) postWebhook(name, url, secret, key string, payload any) {
+	s.webhooks = append(s.webhooks, &delivery{name: name, url: url, secret: secret, key: key, payload: payload})
+	if n := len(s.webhooks) - maxPendingWebhooks; n > 0 {
+		logEvent(slog.LevelError, "webhook_dropped", fmt.Sprintf("too many pending webhooks, dropping %d oldest", n), "count", n)
+		s.webhooks = s.webhooks[n:]
+	}
+	s.retryWebhooks()
+}
+
+// retryWebhooks attempts the pending deliveries that are due.
+func (s *Server) retryWebhooks() {
+	now := now()
+	blocked := make(map[[2]string]bool) // by an earlier delivery that hasn't succeeded yet
+	kept := s.webhooks[:0]
+	for _, d := range s.webhooks {
+		id := [2]string{d.url, d.key}
+		if blocked[id] || d.next.After(now) || !s.attempt(d) {
+			blocked[id] = true
+			kept = append(kept, d)
+		}
+	}
+	clear(s.webhooks[len(kept):])
+	s.webhooks = kept
+}
+
+// attempt posts d, returning false if it needs to be retried.
+func (s *Server) attempt(d *delivery) bool {
+	err := postJSON(d.url, d.payload, d.secret)
+	if err == nil {
+		return true
+	}
+	st := s.settings()
+	d.attempts++
+	if d.attempts >= st.webhookAttempts {
+		logEvent(slog.LevelError, "webhook_failed", fmt.Sprintf("%s failed for %s, giving up after %d attempts: %v", d.name, d.key, d.attempts, err),
+			"key", d.key, "webhook", d.name, "attempts", d.attempts, "error", err)
+		return true
+	}
+	delay := st.webhookBackoff << (d.attempts - 1)
+	d.next = now().Add(delay)
+	logEvent(slog.LevelWarn, "webhook_retry", fmt.Sprintf("%s failed for %s, retrying in %v: %v", d.name, d.key, delay, err),
+		"key", d.key, "webhook", d.name, "attempts", d.attempts, "retry_in", delay.Seconds(), "error", err)
+	return false
+}
+
+// nextWebhookRetry returns when retryWebhooks has something to do, or the
+// zero time if nothing is pending.
+func (s *Server) nextWebhookRetry() time.Time {
+	var next time.Time
+	seen := make(map[[2]string]bool)
+	for _, d := range s.webhooks {
+		id := [2]string{d.url, d.key}
+		if seen[id] {
+			continue // waits for the first one
+		}
+		seen[id] = true
+		if next.IsZero() || d.next.Before(next) {
+			next = d.next
+		}
+	}
+	return next
+}
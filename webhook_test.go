@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWebhookRetry(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := setClock(t, start)
+	var received []string
+	failing := map[string]int{"job-1h": 2, "dead-1h": 100} // requests to fail
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev event
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		if failing[ev.Key] > 0 {
+			failing[ev.Key]--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		received = append(received, fmt.Sprintf("%s %s at %v", ev.Key, ev.Event, now().Sub(start)))
+	}))
+	defer ts.Close()
+
+	s := testServer()
+	st := defaultSettings()
+	st.webhookURL = ts.URL
+	st.webhookAttempts = 3
+	st.webhookBackoff = time.Minute
+	s.current.Store(st)
+	s.notify(&event{Event: eventAlarm, Key: "job-1h"})
+	s.notify(&event{Event: eventRecovery, Key: "job-1h"}) // waits for the alarm
+	s.notify(&event{Event: eventAlarm, Key: "dead-1h"})
+	s.notify(&event{Event: eventAlarm, Key: "web-1h"})
+	for _, at := range []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		if next := s.nextWebhookRetry(); next.IsZero() {
+			t.Fatalf("nothing to retry at %v", at)
+		}
+		*clock = start.Add(at)
+		s.retryWebhooks()
+	}
+	if next := s.nextWebhookRetry(); !next.IsZero() {
+		t.Errorf("still retrying at %v, want dead-1h given up after 3 attempts", next)
+	}
+	want := []string{"web-1h alarm at 0s", "job-1h alarm at 3m0s", "job-1h recovery at 3m0s"}
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("received %q, want %q", received, want)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const wsWriteTimeout = 10 * time.Second
+
+// wsUpgrader only accepts same-origin browser connections, since the token
+// travels in the URL.
+var wsUpgrader = websocket.Upgrader{}
+
+// wsCommand is sent by /ws clients. The ack command (also called snooze)
+// silences key for duration, e.g. 2h, and needs a write token.
+type wsCommand struct {
+	ID       string `json:"id,omitempty"` // echoed in the reply
+	Command  string `json:"command"`
+	Key      string `json:"key"`
+	Duration string `json:"duration"`
+}
+
+// wsMessage is sent to /ws clients: a status change with type status, or a
+// reply to a command with type reply.
+type wsMessage struct {
+	Type string `json:"type"`
+	*statusChange
+	*wsReply
+}
+
+type wsReply struct {
+	ID    string `json:"id,omitempty"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// wsHandler streams status changes like /events, and accepts commands.
+func (s *Server) wsHandler(w http.ResponseWriter, r *http.Request) {
+	token, _ := requestToken(r)
+	canWrite := s.isWriteToken(token)
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has responded
+	}
+	defer conn.Close()
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	replies := make(chan *wsReply, 16)
+	done := make(chan struct{})
+	stop := make(chan struct{}) // tells the reader that nobody takes replies anymore
+	defer close(stop)
+	go func() {
+		defer close(done)
+		s.readWSCommands(conn, canWrite, replies, stop)
+	}()
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+	for {
+		var msg *wsMessage
+		select {
+		case <-done:
+			return
+		case c, ok := <-ch:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+				return
+			}
+			msg = &wsMessage{Type: "status", statusChange: c}
+		case reply := <-replies:
+			msg = &wsMessage{Type: "reply", wsReply: reply}
+		case <-keepalive.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)) != nil {
+				return
+			}
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if conn.WriteJSON(msg) != nil {
+			return
+		}
+	}
+}
+
+// readWSCommands executes the commands sent over conn until it fails or stop
+// is closed. Clients that don't answer pings are disconnected.
+func (s *Server) readWSCommands(conn *websocket.Conn, canWrite bool, replies chan<- *wsReply, stop <-chan struct{}) {
+	conn.SetReadLimit(4096)
+	conn.SetReadDeadline(time.Now().Add(2 * sseKeepalive))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * sseKeepalive))
+	})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var cmd wsCommand
+		reply := &wsReply{}
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			reply.Error = "invalid JSON"
+		} else {
+			reply.ID = cmd.ID
+			reply.Error = s.wsCommand(&cmd, canWrite)
+		}
+		reply.OK = reply.Error == ""
+		select {
+		case replies <- reply:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// wsCommand executes cmd, returning an error message if it fails.
+func (s *Server) wsCommand(cmd *wsCommand, canWrite bool) string {
+	switch cmd.Command {
+	case "ack", "snooze":
+		if !canWrite {
+			return "unauthorized"
+		}
+		dur, _ := time.ParseDuration(cmd.Duration) // 0 if invalid
+		if err := s.Ack(cmd.Key, dur); err != nil {
+			return err.Error()
+		}
+		return ""
+	default:
+		return "unknown command"
+	}
+}